@@ -0,0 +1,377 @@
+package bsa
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/xnyo/papy/bsa/flags"
+)
+
+const (
+	// ba2HeaderSize is the size of the header of BA2 general archives, in bytes
+	ba2HeaderSize = 24
+
+	// ba2RecordSize is the size of a file record in BA2 general archives, in bytes
+	ba2RecordSize = 36
+
+	// ba2RecordFlags is the value of the flags field of the file records in official archives
+	ba2RecordFlags = 0x00100100
+
+	// ba2RecordSentinel terminates each file record
+	ba2RecordSentinel = 0xBAADF00D
+)
+
+// ba2Magic is the BA2 file identifier
+var ba2Magic = [4]byte{'B', 'T', 'D', 'X'}
+
+// ba2General is the type of BA2 archives that can contain any kind of file
+var ba2General = [4]byte{'G', 'N', 'R', 'L'}
+
+// ba2Versions are the supported BA2 versions.
+// Archives from the Fallout 4 next gen update use version 7 and 8, with the same layout.
+var ba2Versions = map[uint32]struct{}{
+	1: {},
+	7: {},
+	8: {},
+}
+
+// ba2Header represents the header of a BA2 archive
+type ba2Header struct {
+	// Magic is always "BTDX"
+	Magic [4]byte
+
+	Version uint32
+
+	// Type is "GNRL" for general archives, "DX10" for texture archives
+	Type [4]byte
+
+	FileCount uint32
+
+	// NameTableOffset is the offset of the file paths, stored after the file data
+	NameTableOffset uint64
+}
+
+// ba2Record represents a file record in BA2 general archives
+type ba2Record struct {
+	NameHash uint32
+	Ext      [4]byte
+	DirHash  uint32
+	Flags    uint32
+	Offset   uint64
+
+	// PackedSize is the size of the zlib compressed data, or 0 if the file is not compressed
+	PackedSize   uint32
+	UnpackedSize uint32
+	Sentinel     uint32
+}
+
+// ba2Hash calculates the BA2 hash of a file name (without extension) or a folder path.
+// It's a crc32 without the initial and final inversion.
+func ba2Hash(s string) uint32 {
+	return ^crc32.Update(0xFFFFFFFF, crc32.IEEETable, []byte(SanitizePath(s)))
+}
+
+// ba2FileHashes returns the hash of the name of f (without extension),
+// its extension as stored in the file record and the hash of its folder
+func ba2FileHashes(f *File) (uint32, [4]byte, uint32) {
+	ext := filepath.Ext(f.Name)
+	var storedExt [4]byte
+	copy(storedExt[:], SanitizePath(strings.TrimPrefix(ext, ".")))
+	var dirHash uint32
+	if f.Folder != nil {
+		dirHash = ba2Hash(f.Folder.Name)
+	}
+	return ba2Hash(strings.TrimSuffix(f.Name, ext)), storedExt, dirHash
+}
+
+// ba2HashCollisions returns an error for each file whose BA2 hashes and extension
+// are the same of another file in folders
+func ba2HashCollisions(folders []*Folder) []error {
+	type key struct {
+		nameHash uint32
+		ext      [4]byte
+		dirHash  uint32
+	}
+	var errs []error
+	seen := make(map[key]*File)
+	for _, folder := range folders {
+		for _, f := range folder.SortedFiles() {
+			nameHash, ext, dirHash := ba2FileHashes(f)
+			k := key{nameHash, ext, dirHash}
+			if other, ok := seen[k]; ok {
+				errs = append(errs, fmt.Errorf("file %s: hash collides with %s", f.Path(), other.Path()))
+				continue
+			}
+			seen[k] = f
+		}
+	}
+	return errs
+}
+
+// isBA2 returns true if the archive is a BA2 archive
+func (b *Bsa) isBA2() bool {
+	return b.Magic == ba2Magic
+}
+
+// readBA2 parses a BA2 general or texture archive.
+// BA2 archives have no folder records, folders are created from the paths in the name table.
+func (b *Bsa) readBA2() error {
+	var header ba2Header
+	if err := binary.Read(io.NewSectionReader(b.r, 0, ba2HeaderSize), binary.LittleEndian, &header); err != nil {
+		return fmt.Errorf("cannot read header: %v", err)
+	}
+	if _, ok := ba2Versions[header.Version]; !ok {
+		return fmt.Errorf("unsupported BA2 version %d", header.Version)
+	}
+	if header.Type != ba2General && header.Type != ba2Textures {
+		return fmt.Errorf("unsupported BA2 archive type %q", header.Type[:])
+	}
+	b.Magic = header.Magic
+	b.Version = flags.Fallout4
+	b.Offset = ba2HeaderSize
+	b.FileCount = header.FileCount
+	b.nameTableOffset = int64(header.NameTableOffset)
+
+	// File records. Texture records are converted to file records, with the hashes
+	// and the offset of the first chunk, the chunks are kept to read the textures.
+	var records []ba2Record
+	var textures []*dx10Texture
+	var err error
+	if header.Type == ba2Textures {
+		textures, err = b.readDX10Records(header.FileCount)
+		for _, t := range textures {
+			records = append(records, t.fileRecord())
+		}
+	} else {
+		records, err = b.readBA2Records(header.FileCount)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Name table. Placeholder names are made of the hashes if it's missing.
+	paths := make([]string, len(records))
+	if header.NameTableOffset != 0 {
+		in := bufio.NewReader(io.NewSectionReader(b.r, int64(header.NameTableOffset), 1<<62))
+		for i := range paths {
+			var length uint16
+			if err := binary.Read(in, binary.LittleEndian, &length); err != nil {
+				return fmt.Errorf("cannot read file name %d: %v", i, err)
+			}
+			p := make([]byte, length)
+			if _, err := io.ReadFull(in, p); err != nil {
+				return fmt.Errorf("cannot read file name %d: %v", i, err)
+			}
+			paths[i] = string(p)
+		}
+	} else {
+		for i, record := range records {
+			paths[i] = fmt.Sprintf("%08x\\%08x.%s", record.DirHash, record.NameHash, strings.TrimRight(string(record.Ext[:]), "\x00"))
+		}
+	}
+
+	seen := make(map[*Folder]struct{})
+	b.ba2Records = make(map[*File]*ba2Record, len(records))
+	if textures != nil {
+		b.dx10Textures = make(map[*File]*dx10Texture, len(textures))
+	}
+	for i := range records {
+		record := &records[i]
+		file := &File{
+			Size:       record.UnpackedSize,
+			Offset:     record.Offset,
+			StoredSize: record.UnpackedSize,
+			Compressed: record.PackedSize != 0,
+			archive:    b,
+		}
+		if file.Compressed {
+			file.StoredSize = record.PackedSize
+		}
+		if textures != nil {
+			textures[i].setSizes(file)
+			b.dx10Textures[file] = textures[i]
+		}
+		if err := checkEntryPath(paths[i]); err != nil {
+			return err
+		}
+		if err := b.Root.AddFile(paths[i], file); err != nil {
+			return err
+		}
+		b.ba2Records[file] = record
+		if _, ok := seen[file.Folder]; !ok {
+			seen[file.Folder] = struct{}{}
+			b.folders = append(b.folders, file.Folder)
+		}
+	}
+	b.FolderCount = uint32(len(b.folders))
+	return nil
+}
+
+// readBA2Records reads the file records of a BA2 general archive
+func (b *Bsa) readBA2Records(count uint32) ([]ba2Record, error) {
+	if err := b.checkCount("file", uint64(count), ba2RecordSize, ba2HeaderSize); err != nil {
+		return nil, err
+	}
+	var records []ba2Record
+	in := bufio.NewReader(io.NewSectionReader(b.r, ba2HeaderSize, int64(count)*ba2RecordSize))
+	for i := uint32(0); i < count; i++ {
+		var record ba2Record
+		if err := binary.Read(in, binary.LittleEndian, &record); err != nil {
+			return nil, fmt.Errorf("cannot read file record %d: %v", i, err)
+		}
+		records = append(records, record)
+	}
+	b.dataStart = ba2HeaderSize + int64(count)*ba2RecordSize
+	return records, nil
+}
+
+// verifyBA2Records checks the hashes of the records of a BA2 archive,
+// and that file data does not overlap the name table.
+// The data of textures is checked by verifyDX10Chunks.
+func (b *Bsa) verifyBA2Records() []error {
+	var errs []error
+	for _, folder := range b.folders {
+		for _, f := range folder.files {
+			record := b.ba2Records[f]
+			nameHash, ext, dirHash := ba2FileHashes(f)
+			if record.DirHash != dirHash {
+				errs = append(errs, fmt.Errorf("file %s: folder hash is %08x, expected %08x", f.Path(), record.DirHash, dirHash))
+			}
+			if record.NameHash != nameHash {
+				errs = append(errs, fmt.Errorf("file %s: name hash is %08x, expected %08x", f.Path(), record.NameHash, nameHash))
+			}
+			if record.Ext != ext {
+				errs = append(errs, fmt.Errorf("file %s: extension is %q, expected %q", f.Path(), record.Ext[:], ext[:]))
+			}
+			if end := int64(f.Offset) + int64(f.StoredSize); !b.isDX10() && b.nameTableOffset != 0 && end > b.nameTableOffset {
+				errs = append(errs, fmt.Errorf("file %s: data overlaps the name table", f.Path()))
+			}
+		}
+	}
+	return errs
+}
+
+// ba2Files returns the folders and the files in root, in the same order they are written in BA2 archives
+func ba2Files(root *Root) ([]*Folder, []*File, error) {
+	folders := root.Folders()
+	var files []*File
+	for _, folder := range folders {
+		for _, file := range folder.SortedFiles() {
+			if file.Size > maxFileSize {
+				return nil, nil, fmt.Errorf("file %s is too big (%d bytes)", file.Path(), file.Size)
+			}
+			if len(file.Path()) > 0xFFFF {
+				return nil, nil, fmt.Errorf("file path %s is too long", file.Path())
+			}
+			files = append(files, file)
+		}
+	}
+	return folders, files, nil
+}
+
+// writeBA2NameTable writes the paths of files, prefixed by their length.
+// It returns the size of the name table.
+func writeBA2NameTable(out io.Writer, files []*File) (int64, error) {
+	var size int64
+	for _, file := range files {
+		if err := binary.Write(out, binary.LittleEndian, uint16(len(file.Path()))); err != nil {
+			return 0, fmt.Errorf("cannot write file name %s: %v", file.Path(), err)
+		}
+		if _, err := io.WriteString(out, file.Path()); err != nil {
+			return 0, fmt.Errorf("cannot write file name %s: %v", file.Path(), err)
+		}
+		size += 2 + int64(len(file.Path()))
+	}
+	return size, nil
+}
+
+// writeBA2 writes the files in root to out, as a BA2 general archive.
+// Like BSA archives, file data is streamed and the records are patched afterwards.
+func (w *Writer) writeBA2(out io.WriteSeeker, root *Root) error {
+	folders, files, err := ba2Files(root)
+	if err != nil {
+		return err
+	}
+	start, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(out)
+
+	// Header and file records.
+	// Offsets, compressed sizes and the name table offset are not known yet, they will be patched later.
+	header := ba2Header{
+		Magic:     ba2Magic,
+		Version:   uint32(flags.Fallout4),
+		Type:      ba2General,
+		FileCount: uint32(len(files)),
+	}
+	records := make([]ba2Record, len(files))
+	for i, file := range files {
+		nameHash, ext, dirHash := ba2FileHashes(file)
+		records[i] = ba2Record{
+			NameHash:     nameHash,
+			Ext:          ext,
+			DirHash:      dirHash,
+			Flags:        ba2RecordFlags,
+			UnpackedSize: file.Size,
+			Sentinel:     ba2RecordSentinel,
+		}
+	}
+	if err := binary.Write(buf, binary.LittleEndian, header); err != nil {
+		return fmt.Errorf("cannot write header: %v", err)
+	}
+	if err := binary.Write(buf, binary.LittleEndian, records); err != nil {
+		return fmt.Errorf("cannot write file records: %v", err)
+	}
+
+	// File data. Compressed data has no original size prefix, it's in the record.
+	done := make(chan struct{})
+	defer close(done)
+	queue := w.compressFiles(folders, done)
+	offset := int64(ba2HeaderSize) + int64(len(files))*ba2RecordSize
+	for i, file := range files {
+		packed := queue.next()
+		if packed.err != nil {
+			return packed.err
+		}
+		size, err := writePackedData(buf, file, packed)
+		if err != nil {
+			return err
+		}
+		records[i].Offset = uint64(offset)
+		if packed.compressed {
+			records[i].PackedSize = size
+		}
+		offset += int64(size)
+	}
+
+	// Name table
+	header.NameTableOffset = uint64(offset)
+	size, err := writeBA2NameTable(buf, files)
+	if err != nil {
+		return err
+	}
+	offset += size
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+
+	// Patch the header and the file records
+	if _, err := out.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	if err := binary.Write(out, binary.LittleEndian, header); err != nil {
+		return fmt.Errorf("cannot write header: %v", err)
+	}
+	if err := binary.Write(out, binary.LittleEndian, records); err != nil {
+		return fmt.Errorf("cannot write file records: %v", err)
+	}
+	_, err = out.Seek(start+offset, io.SeekStart)
+	return err
+}
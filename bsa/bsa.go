@@ -1,14 +1,30 @@
 package bsa
 
 import (
+	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+
+	"github.com/xnyo/papy/bsa/flags"
 )
 
 // SanitizePath sanitizes a path for tes hash calculation.
 // Basically makes it lowercase and replaces slashes with backslashes.
+// Only ASCII letters are lowercased, byte by byte, like the engine does.
 func SanitizePath(path string) string {
-	return strings.ToLower(strings.ReplaceAll(path, "/", "\\"))
+	b := []byte(path)
+	for i, c := range b {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		case c == '/':
+			b[i] = '\\'
+		}
+	}
+	return string(b)
 }
 
 var tesHashExtMap = map[string]uint64{
@@ -20,34 +36,49 @@ var tesHashExtMap = map[string]uint64{
 
 // TesHash calculates the BSA hash for the specified file name.
 // The provided path will be treated as case insensitive, and may contain either
-// slashes or backslashes as path separators (will be sanitized)
+// slashes or backslashes as path separators (will be sanitized).
+// Only the file name is hashed, the folders in the path are ignored.
 func TesHash(path string) uint64 {
 	path = SanitizePath(path)
-	ext := filepath.Ext(path)
-	root := filepath.Base(path)
-	root = root[:len(root)-len(ext)]
-
-	chars := make([]uint64, len(root))
-	for i, x := range root {
-		chars[i] = uint64(x)
+	name := path[strings.LastIndex(path, "\\")+1:]
+	ext := ""
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		ext = name[i:]
 	}
-	hash1 := chars[len(chars)-1]
-	if len(chars) > 2 {
-		hash1 |= chars[len(chars)-2] << 8
+	return tesHash(name[:len(name)-len(ext)], ext)
+}
+
+// tesHash calculates the BSA hash of an already sanitized
+// root (name without extension) and extension.
+// Names are hashed byte by byte, like the engine does.
+func tesHash(root string, ext string) uint64 {
+	var hash1 uint64
+	if n := len(root); n > 0 {
+		hash1 = uint64(root[n-1])
+		if n > 2 {
+			hash1 |= uint64(root[n-2]) << 8
+		}
+		hash1 |= uint64(n)<<16 | uint64(root[0])<<24
 	}
-	hash1 |= uint64(len(chars)<<16) | chars[0]<<24 | tesHashExtMap[ext]
+	hash1 |= tesHashExtMap[ext]
 	var uintMask, hash2, hash3 uint64 = 0xFFFFFFFF, 0, 0
-	for _, char := range chars[1 : len(chars)-2] {
-		hash2 = ((hash2 * 0x1003F) + char) & uintMask
+	for i := 1; i < len(root)-2; i++ {
+		hash2 = ((hash2 * 0x1003F) + uint64(root[i])) & uintMask
 	}
-
-	for _, char := range ext {
-		hash3 = ((hash3 * 0x1003F) + uint64(char)) & uintMask
+	for i := 0; i < len(ext); i++ {
+		hash3 = ((hash3 * 0x1003F) + uint64(ext[i])) & uintMask
 	}
 	hash2 = (hash2 + hash3) & uintMask
 	return (hash2 << 32) + hash1
 }
 
+// FolderHash calculates the BSA hash for the specified folder path.
+// Folders are hashed as a whole path, without extension handling,
+// so dots in folder names are hashed like any other character.
+func FolderHash(path string) uint64 {
+	return tesHash(strings.Trim(SanitizePath(path), "\\"), "")
+}
+
 // TesHashable ...
 type TesHashable interface {
 	TesHash() uint64
@@ -62,7 +93,8 @@ type Node struct {
 // TesHash returns a cached version of the TesHash associated to this object
 func (n *Node) TesHash() uint64 {
 	if n.tesHash == nil {
-		*n.tesHash = TesHash(n.Name)
+		h := TesHash(n.Name)
+		n.tesHash = &h
 	}
 	return *n.tesHash
 }
@@ -74,56 +106,236 @@ func (a ByTesHash) Len() int           { return len(a) }
 func (a ByTesHash) Less(i, j int) bool { return a[i].TesHash() < a[j].TesHash() }
 func (a ByTesHash) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 
+// lessByTesHash compares two nodes by their tes hash.
+// Nodes with the same hash are compared by name, so the order is always the same
+// regardless of the order the nodes have been added in.
+func lessByTesHash(a TesHashable, aName string, b TesHashable, bName string) bool {
+	if a.TesHash() != b.TesHash() {
+		return a.TesHash() < b.TesHash()
+	}
+	return aName < bName
+}
+
 // Root represents the root of a BSA archive.
 // It can only contain subfolders
 type Root struct {
 	Node
-	Subfolders []Folder
+	Subfolders []*Folder
+}
+
+// NewRoot instantiates an empty Root
+func NewRoot() *Root {
+	return &Root{}
+}
+
+// Folder returns the folder at the specified path, creating it
+// (and all its parents) if it does not exist yet
+func (r *Root) Folder(path string) *Folder {
+	path = strings.Trim(SanitizePath(path), "\\")
+	subfolders := &r.Subfolders
+	var folder *Folder
+	parts := strings.Split(path, "\\")
+	for i := range parts {
+		name := strings.Join(parts[:i+1], "\\")
+		folder = nil
+		for _, sf := range *subfolders {
+			if sf.Name == name {
+				folder = sf
+				break
+			}
+		}
+		if folder == nil {
+			folder = NewFolder(name)
+			*subfolders = append(*subfolders, folder)
+		}
+		subfolders = &folder.Subfolders
+	}
+	return folder
+}
+
+// AddFile adds a file to the archive, at the specified path.
+// The path must contain the folder and the file name (eg: meshes/foo/bar.nif)
+func (r *Root) AddFile(path string, newFile *File) error {
+	path = strings.TrimLeft(SanitizePath(path), "\\")
+	i := strings.LastIndex(path, "\\")
+	if i <= 0 || i == len(path)-1 {
+		return fmt.Errorf("invalid archive file path %s, it must be in the format folder\\file", path)
+	}
+	folder := r.Folder(path[:i])
+	if folder.File(path[i+1:]) != nil {
+		return fmt.Errorf("file %s is already present in the archive", path)
+	}
+	newFile.Name = path[i+1:]
+	newFile.tesHash = nil
+	folder.AddFile(newFile)
+	return nil
+}
+
+// Folders returns all folders that contain at least one file, sorted by their tes hash.
+// This is the flat list of folders that gets written to the archive.
+func (r *Root) Folders() []*Folder {
+	var result []*Folder
+	var walk func(folders []*Folder)
+	walk = func(folders []*Folder) {
+		for _, f := range folders {
+			if len(f.files) > 0 {
+				result = append(result, f)
+			}
+			walk(f.Subfolders)
+		}
+	}
+	walk(r.Subfolders)
+	sort.Slice(result, func(i, j int) bool {
+		return lessByTesHash(result[i], result[i].Name, result[j], result[j].Name)
+	})
+	return result
+}
+
+// FileCount returns the number of files in the archive
+func (r *Root) FileCount() int {
+	var count int
+	for _, f := range r.Folders() {
+		count += len(f.files)
+	}
+	return count
+}
+
+// FileFlags returns the content type flags of the archive, from the paths of its files
+func (r *Root) FileFlags() flags.FileFlags {
+	var result flags.FileFlags
+	for _, folder := range r.Folders() {
+		for _, f := range folder.files {
+			result |= flags.PathToFileFlags(f.Path())
+		}
+	}
+	return result
 }
 
 // Folder represents a folder inside a BSA archive.
+// Its name is the full path of the folder, relative to the archive root.
 // Use NewFolder to instantiate a Folder struct
 type Folder struct {
 	Node
-	Bsa        Bsa
-	files      []File
-	Subfolders *[]Folder
+	files      []*File
+	Subfolders []*Folder
 
-	sortedFiles *[]File
+	index       map[string]*File
+	sortedFiles []*File
 }
 
-func (f *Folder) addFile(newFile File) {
+// TesHash returns a cached version of the folder hash (see FolderHash)
+func (f *Folder) TesHash() uint64 {
+	if f.tesHash == nil {
+		h := FolderHash(f.Name)
+		f.tesHash = &h
+	}
+	return *f.tesHash
+}
+
+// AddFile adds a file to this folder
+func (f *Folder) AddFile(newFile *File) {
+	newFile.Folder = f
 	f.files = append(f.files, newFile)
+	if f.index == nil {
+		f.index = make(map[string]*File)
+	}
+	f.index[newFile.Name] = newFile
 	f.sortedFiles = nil
 }
 
+// File returns the file with the specified name in this folder, or nil if it does not exist
+func (f *Folder) File(name string) *File {
+	return f.index[SanitizePath(name)]
+}
+
 // SortedFiles returns all files in the current folder, sorted by their tes hash
+// (and by name, if two files have the same hash).
 // This function's result is cached, meaning that calling it multiple times
 // without editing the files slice takes θ(1)
-func (f *Folder) SortedFiles() *[]File {
-	// a := File{}
+func (f *Folder) SortedFiles() []*File {
 	if f.sortedFiles == nil {
-		/*a := ByTesHash(f.files)
-		f.sortedFiles = sort.Sort(a)*/
+		f.sortedFiles = make([]*File, len(f.files))
+		copy(f.sortedFiles, f.files)
+		sort.Slice(f.sortedFiles, func(i, j int) bool {
+			a, b := f.sortedFiles[i], f.sortedFiles[j]
+			return lessByTesHash(a, a.Name, b, b.Name)
+		})
 	}
 	return f.sortedFiles
 }
 
 // NewFolder instantiates a new Folder
-func NewFolder(path string) Folder {
-	return Folder{
+func NewFolder(path string) *Folder {
+	return &Folder{
 		Node: Node{
 			Name: SanitizePath(path),
 		},
 	}
 }
 
-// File represents a folder inside a BSA archive.
+// File represents a file inside a BSA archive.
+// Its name is the file name only, the path is determined by its Folder
 type File struct {
 	Node
-	Folder       Folder
-	RecordOffset *uint64
+	Folder *Folder
+
+	// Size is the size of the uncompressed file data, in bytes
+	Size uint32
+
+	// SourcePath is the path of the loose file on disk that will be packed
+	SourcePath string
+
+	// Offset is the offset of the file data block inside the archive it was read from
+	Offset uint64
+
+	// StoredSize is the size of the file data block inside the archive it was read from,
+	// including the embedded file name and the original size, if present
+	StoredSize uint32
+
+	// Compressed is true if the file data inside the archive it was read from is compressed
+	Compressed bool
+
+	// archive is the archive this file was read from, if any
+	archive *Bsa
 }
 
-// Bsa represents a BSA archive
-type Bsa struct{}
+// NewLooseFile instantiates a new File from a loose file on disk
+func NewLooseFile(sourcePath string) (*File, error) {
+	s, err := os.Stat(sourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat file %s: %v", sourcePath, err)
+	}
+	if s.IsDir() {
+		return nil, fmt.Errorf("%s is dir, expected file", sourcePath)
+	}
+	if s.Size() > maxFileSize {
+		return nil, fmt.Errorf("%s is too big to be packed (%d bytes)", sourcePath, s.Size())
+	}
+	return &File{
+		Node: Node{
+			Name: SanitizePath(filepath.Base(sourcePath)),
+		},
+		Size:       uint32(s.Size()),
+		SourcePath: sourcePath,
+	}, nil
+}
+
+// Path returns the full path of the file inside the archive
+func (f *File) Path() string {
+	if f.Folder == nil || f.Folder.Name == "" {
+		return f.Name
+	}
+	return f.Folder.Name + "\\" + f.Name
+}
+
+// Open opens the file data for reading.
+// If the file was read from an archive, its data is read lazily from the archive.
+func (f *File) Open() (io.ReadCloser, error) {
+	if f.archive != nil {
+		return f.archive.openFile(f)
+	}
+	if f.SourcePath == "" {
+		return nil, fmt.Errorf("file %s has no data source", f.Path())
+	}
+	return os.Open(f.SourcePath)
+}
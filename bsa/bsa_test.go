@@ -0,0 +1,126 @@
+package bsa
+
+import (
+	"testing"
+)
+
+func TestTesHash(t *testing.T) {
+	tests := []struct {
+		path string
+		hash uint64
+	}{
+		// Files from the vanilla archives
+		{`meshes\actors\character\character assets\skeleton.nif`, 0x875cfa7e7308ef6e},
+		{`actors\character\animations\mt_idle.kf`, 0x5b59558f6d076ce5},
+		{`textures\actors\character\male\malebody_1.dds`, 0xe1c345c16d0adfb1},
+		{`sound\fx\npc\horse\foot\npc_horse_foot_walk_01.wav`, 0xcf519d31ee163031},
+		{`scripts\actor.pex`, 0x94287ce661056f72},
+		{`interface\fonts_en.swf`, 0x404e9d956608656e},
+		{`strings\skyrim_english.strings`, 0x195e35f8730e7368},
+
+		// Short roots
+		{`a.pex`, 0x93c5641561010061},
+		{`ab.pex`, 0x93c5641561020062},
+		{`abc`, 0x0000000061036263},
+		{`a`, 0x0000000061010061},
+		{`ab`, 0x0000000061020062},
+		{`readme`, 0x321d362872066d65},
+
+		// Empty roots (extension only)
+		{`.nif`, 0x92cd45fd00008000},
+		{`.dds`, 0x8ddba9c500008080},
+		{`x\.kf`, 0x1711e3e900000080},
+		{``, 0},
+
+		// Mixed case and forward slashes
+		{`Meshes/Clutter/Bucket01.NIF`, 0xd10cff896208b031},
+		{`TEXTURES\Sky\Skyrimcloudsupper04.DDS`, 0x2ece2b017313b0b4},
+
+		// Non-ASCII letters keep their case, only ASCII letters are lowercased
+		{`É.nif`, 0x92cd45fdc3028089},
+		{`é.nif`, 0x92cd45fdc30280a9},
+		{"\xc9.nif", 0x92cd45fdc90180c9},
+		{"\xe9.nif", 0x92cd45fde90180e9},
+		{"K.nif", 0x92cd45fde20384aa}, // Kelvin sign
+		{`k.nif`, 0x92cd45fd6b01806b},
+		{`textures\Über\Größe.dds`, 0xa6a09ba367079fe5},
+		{`sound\voice\Ångström_01.WAV`, 0x55d987f6c30d3031},
+		{`meshes\CAFÉ\tablE.nif`, 0x932e5e3e7405ec65},
+	}
+	for _, tt := range tests {
+		if got := TesHash(tt.path); got != tt.hash {
+			t.Errorf("TesHash(%q) = %#016x, want %#016x", tt.path, got, tt.hash)
+		}
+	}
+}
+
+func TestFolderHash(t *testing.T) {
+	tests := []struct {
+		path string
+		hash uint64
+	}{
+		{`meshes\actors\character\character assets`, 0x650544d86d287473},
+		{`textures\actors\character\male`, 0x70d22595741e6c65},
+		{`scripts`, 0x36aebb9673077473},
+		{`sound\fx`, 0xeda95b2073086678},
+		{`a`, 0x0000000061010061},
+		{`ab`, 0x0000000061020062},
+		{``, 0},
+		{`Meshes/Clutter`, 0x8948be786d0e6572},
+		{`\Meshes\Clutter\`, 0x8948be786d0e6572},
+		{`textures\Über`, 0x8498b199740e6572},
+		{`meshes\CAFÉ`, 0xb7d0dab46d0cc389},
+		{`meshes\café`, 0xb7d0dab46d0cc3a9},
+
+		// Dots in folder names are not extensions
+		{`meshes\effects\fxfire.nif.old`, 0x7a76a3f46d1d6c64},
+	}
+	for _, tt := range tests {
+		if got := FolderHash(tt.path); got != tt.hash {
+			t.Errorf("FolderHash(%q) = %#016x, want %#016x", tt.path, got, tt.hash)
+		}
+	}
+}
+
+// swapCaseAndSlashes returns path with the case of ASCII letters and the
+// direction of slashes swapped, that must not change its hash
+func swapCaseAndSlashes(path string) string {
+	b := []byte(path)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		case c == '/':
+			b[i] = '\\'
+		case c == '\\':
+			b[i] = '/'
+		}
+	}
+	return string(b)
+}
+
+func FuzzTesHash(f *testing.F) {
+	for _, seed := range []string{"", ".", "a", "ab", ".nif", "a.kf", `x\.dds`, "Meshes/Foo/Bar.NIF", `\\`, "é.wav", "É.WAV", "\xc9.nif"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, path string) {
+		if TesHash(path) != TesHash(swapCaseAndSlashes(path)) {
+			t.Errorf("TesHash(%q) depends on case or slashes", path)
+		}
+		if FolderHash(path) != FolderHash(swapCaseAndSlashes(path)) {
+			t.Errorf("FolderHash(%q) depends on case or slashes", path)
+		}
+		sanitized := SanitizePath(path)
+		if len(sanitized) != len(path) {
+			t.Fatalf("SanitizePath(%q) = %q, changes the length", path, sanitized)
+		}
+		for i := 0; i < len(path); i++ {
+			if path[i] >= 0x80 && sanitized[i] != path[i] {
+				t.Errorf("SanitizePath(%q) = %q, changes non-ASCII bytes", path, sanitized)
+				break
+			}
+		}
+	})
+}
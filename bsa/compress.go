@@ -0,0 +1,59 @@
+package bsa
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+
+	"github.com/pierrec/lz4/v4"
+	"github.com/xnyo/papy/bsa/flags"
+)
+
+// zlibLevel is the zlib compression level.
+// It's fixed so the same input always produces the same archive.
+const zlibLevel = zlib.BestCompression
+
+// lz4Options are the LZ4 frame options.
+// They are fixed so the same input always produces the same archive.
+var lz4Options = []lz4.Option{
+	lz4.BlockSizeOption(lz4.Block4Mb),
+	lz4.ChecksumOption(true),
+	lz4.CompressionLevelOption(lz4.Fast),
+	lz4.ConcurrencyOption(1),
+}
+
+// compress compresses data with the codec used by the game.
+// Skyrim Special Edition uses LZ4 frames, older games use zlib.
+func compress(game flags.Game, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	if game == flags.Special {
+		lw := lz4.NewWriter(&buf)
+		if err := lw.Apply(lz4Options...); err != nil {
+			return nil, err
+		}
+		w = lw
+	} else {
+		zw, err := zlib.NewWriterLevel(&buf, zlibLevel)
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressor returns a reader that decompresses r with the codec used by the game
+func decompressor(game flags.Game, r io.Reader) (io.ReadCloser, error) {
+	if game == flags.Special {
+		return ioutil.NopCloser(lz4.NewReader(r)), nil
+	}
+	return zlib.NewReader(r)
+}
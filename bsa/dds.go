@@ -0,0 +1,365 @@
+package bsa
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// ddsHeaderSize is the size of the DDS header, excluding the magic, in bytes
+	ddsHeaderSize = 124
+
+	// ddsPixelFormatFourCC is set if the pixel format is identified by its FourCC
+	ddsPixelFormatFourCC = 0x4
+
+	// ddsPixelFormatRGB is set if the texture contains uncompressed RGB data
+	ddsPixelFormatRGB = 0x40
+
+	// ddsPixelFormatLuminance is set if the texture contains uncompressed luminance data
+	ddsPixelFormatLuminance = 0x20000
+
+	// ddsPixelFormatAlphaPixels is set if uncompressed RGB data has an alpha channel
+	ddsPixelFormatAlphaPixels = 0x1
+
+	// ddsCaps2Cubemap is set if the texture is a cubemap
+	ddsCaps2Cubemap = 0x200
+
+	// ddsCaps2AllFaces is set if a cubemap contains all its faces
+	ddsCaps2AllFaces = 0xFC00
+
+	// ddsCaps2Volume is set if the texture is a volume texture
+	ddsCaps2Volume = 0x200000
+
+	// ddsFlagsRequired are the flags set in every DDS header: caps, height, width, pixel format and mipmap count
+	ddsFlagsRequired = 0x1 | 0x2 | 0x4 | 0x1000 | 0x20000
+
+	// ddsFlagsPitch is set if the header contains the pitch of uncompressed textures
+	ddsFlagsPitch = 0x8
+
+	// ddsFlagsLinearSize is set if the header contains the size of the first mipmap of compressed textures
+	ddsFlagsLinearSize = 0x80000
+
+	// ddsCapsTexture is set in every DDS header
+	ddsCapsTexture = 0x1000
+
+	// ddsCapsComplex is set if the texture has mipmaps or is a cubemap
+	ddsCapsComplex = 0x8
+
+	// ddsCapsMipMap is set if the texture has mipmaps
+	ddsCapsMipMap = 0x400000
+
+	// ddsDimensionTexture2D is the resource dimension of 2D textures and cubemaps in DX10 headers
+	ddsDimensionTexture2D = 3
+
+	// ddsMiscTextureCube is set in DX10 headers if the texture is a cubemap
+	ddsMiscTextureCube = 0x4
+)
+
+// ddsMagic is the DDS file identifier
+var ddsMagic = [4]byte{'D', 'D', 'S', ' '}
+
+// ddsPixelFormat represents the pixel format in a DDS header
+type ddsPixelFormat struct {
+	Size        uint32
+	Flags       uint32
+	FourCC      [4]byte
+	RGBBitCount uint32
+	RBitMask    uint32
+	GBitMask    uint32
+	BBitMask    uint32
+	ABitMask    uint32
+}
+
+// ddsHeader represents the header of a DDS file, after the magic
+type ddsHeader struct {
+	Size              uint32
+	Flags             uint32
+	Height            uint32
+	Width             uint32
+	PitchOrLinearSize uint32
+	Depth             uint32
+	MipMapCount       uint32
+	Reserved1         [11]uint32
+	PixelFormat       ddsPixelFormat
+	Caps              uint32
+	Caps2             uint32
+	Caps3             uint32
+	Caps4             uint32
+	Reserved2         uint32
+}
+
+// ddsHeaderDX10 represents the extended header of DDS files with the "DX10" FourCC
+type ddsHeaderDX10 struct {
+	DXGIFormat        uint32
+	ResourceDimension uint32
+	MiscFlag          uint32
+	ArraySize         uint32
+	MiscFlags2        uint32
+}
+
+// DXGI formats supported by the game
+const (
+	dxgiR8G8B8A8Unorm     = 28
+	dxgiR8G8B8A8UnormSRGB = 29
+	dxgiR8Unorm           = 61
+	dxgiBC1Unorm          = 71
+	dxgiBC1UnormSRGB      = 72
+	dxgiBC2Unorm          = 74
+	dxgiBC2UnormSRGB      = 75
+	dxgiBC3Unorm          = 77
+	dxgiBC3UnormSRGB      = 78
+	dxgiBC4Unorm          = 80
+	dxgiBC4Snorm          = 81
+	dxgiBC5Unorm          = 83
+	dxgiBC5Snorm          = 84
+	dxgiB8G8R8A8Unorm     = 87
+	dxgiB8G8R8X8Unorm     = 88
+	dxgiB8G8R8A8UnormSRGB = 91
+	dxgiBC6HUF16          = 95
+	dxgiBC6HSF16          = 96
+	dxgiBC7Unorm          = 98
+	dxgiBC7UnormSRGB      = 99
+)
+
+// dxgiFormatInfo describes how the pixels of a DXGI format are stored
+type dxgiFormatInfo struct {
+	// blockCompressed is true if pixels are stored in blocks of 4x4
+	blockCompressed bool
+
+	// size is the size of a block, if the format is block compressed,
+	// or the size of a pixel, in bytes
+	size int64
+}
+
+// dxgiFormats are the DXGI formats that can be packed in BA2 texture archives
+var dxgiFormats = map[uint32]dxgiFormatInfo{
+	dxgiR8G8B8A8Unorm:     {false, 4},
+	dxgiR8G8B8A8UnormSRGB: {false, 4},
+	dxgiR8Unorm:           {false, 1},
+	dxgiBC1Unorm:          {true, 8},
+	dxgiBC1UnormSRGB:      {true, 8},
+	dxgiBC2Unorm:          {true, 16},
+	dxgiBC2UnormSRGB:      {true, 16},
+	dxgiBC3Unorm:          {true, 16},
+	dxgiBC3UnormSRGB:      {true, 16},
+	dxgiBC4Unorm:          {true, 8},
+	dxgiBC4Snorm:          {true, 8},
+	dxgiBC5Unorm:          {true, 16},
+	dxgiBC5Snorm:          {true, 16},
+	dxgiB8G8R8A8Unorm:     {false, 4},
+	dxgiB8G8R8X8Unorm:     {false, 4},
+	dxgiB8G8R8A8UnormSRGB: {false, 4},
+	dxgiBC6HUF16:          {true, 16},
+	dxgiBC6HSF16:          {true, 16},
+	dxgiBC7Unorm:          {true, 16},
+	dxgiBC7UnormSRGB:      {true, 16},
+}
+
+// fourCCFormats are the DXGI formats of legacy DDS files, by FourCC
+var fourCCFormats = map[[4]byte]uint32{
+	{'D', 'X', 'T', '1'}: dxgiBC1Unorm,
+	{'D', 'X', 'T', '3'}: dxgiBC2Unorm,
+	{'D', 'X', 'T', '5'}: dxgiBC3Unorm,
+	{'A', 'T', 'I', '1'}: dxgiBC4Unorm,
+	{'B', 'C', '4', 'U'}: dxgiBC4Unorm,
+	{'B', 'C', '4', 'S'}: dxgiBC4Snorm,
+	{'A', 'T', 'I', '2'}: dxgiBC5Unorm,
+	{'B', 'C', '5', 'U'}: dxgiBC5Unorm,
+	{'B', 'C', '5', 'S'}: dxgiBC5Snorm,
+}
+
+// legacyPixelFormats are the pixel formats written in the headers of textures read from
+// BA2 texture archives, for the formats that don't need a DX10 header
+var legacyPixelFormats = map[uint32]ddsPixelFormat{
+	dxgiBC1Unorm:      {Flags: ddsPixelFormatFourCC, FourCC: [4]byte{'D', 'X', 'T', '1'}},
+	dxgiBC2Unorm:      {Flags: ddsPixelFormatFourCC, FourCC: [4]byte{'D', 'X', 'T', '3'}},
+	dxgiBC3Unorm:      {Flags: ddsPixelFormatFourCC, FourCC: [4]byte{'D', 'X', 'T', '5'}},
+	dxgiBC4Unorm:      {Flags: ddsPixelFormatFourCC, FourCC: [4]byte{'A', 'T', 'I', '1'}},
+	dxgiBC5Unorm:      {Flags: ddsPixelFormatFourCC, FourCC: [4]byte{'A', 'T', 'I', '2'}},
+	dxgiR8G8B8A8Unorm: {Flags: ddsPixelFormatRGB | ddsPixelFormatAlphaPixels, RGBBitCount: 32, RBitMask: 0xFF, GBitMask: 0xFF00, BBitMask: 0xFF0000, ABitMask: 0xFF000000},
+	dxgiB8G8R8A8Unorm: {Flags: ddsPixelFormatRGB | ddsPixelFormatAlphaPixels, RGBBitCount: 32, RBitMask: 0xFF0000, GBitMask: 0xFF00, BBitMask: 0xFF, ABitMask: 0xFF000000},
+	dxgiB8G8R8X8Unorm: {Flags: ddsPixelFormatRGB, RGBBitCount: 32, RBitMask: 0xFF0000, GBitMask: 0xFF00, BBitMask: 0xFF},
+	dxgiR8Unorm:       {Flags: ddsPixelFormatLuminance, RGBBitCount: 8, RBitMask: 0xFF},
+}
+
+// ddsTexture contains the information of a DDS texture needed to pack it in BA2 texture archives
+type ddsTexture struct {
+	width    uint32
+	height   uint32
+	mipCount uint32
+	format   uint32
+	cubemap  bool
+
+	// dataOffset is the offset of the pixel data, after the headers
+	dataOffset int64
+}
+
+// readDDSHeader reads the headers of a DDS texture from r
+func readDDSHeader(r io.Reader) (*ddsTexture, error) {
+	var fileMagic [4]byte
+	if err := binary.Read(r, binary.LittleEndian, &fileMagic); err != nil {
+		return nil, fmt.Errorf("cannot read DDS header: %v", err)
+	}
+	if fileMagic != ddsMagic {
+		return nil, fmt.Errorf("not a DDS file")
+	}
+	var header ddsHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("cannot read DDS header: %v", err)
+	}
+	if header.Size != ddsHeaderSize {
+		return nil, fmt.Errorf("invalid DDS header size %d", header.Size)
+	}
+	t := ddsTexture{
+		width:      header.Width,
+		height:     header.Height,
+		mipCount:   header.MipMapCount,
+		cubemap:    header.Caps2&ddsCaps2Cubemap != 0,
+		dataOffset: 4 + ddsHeaderSize,
+	}
+	if t.mipCount == 0 {
+		t.mipCount = 1
+	}
+	if t.width == 0 || t.height == 0 {
+		return nil, fmt.Errorf("invalid DDS size %dx%d", t.width, t.height)
+	}
+	if header.Depth > 1 || header.Caps2&ddsCaps2Volume != 0 {
+		return nil, fmt.Errorf("volume textures are not supported")
+	}
+
+	pf := header.PixelFormat
+	hasDX10Header := pf.Flags&ddsPixelFormatFourCC != 0 && pf.FourCC == [4]byte{'D', 'X', '1', '0'}
+	switch {
+	case hasDX10Header:
+		var dx10 ddsHeaderDX10
+		if err := binary.Read(r, binary.LittleEndian, &dx10); err != nil {
+			return nil, fmt.Errorf("cannot read DDS DX10 header: %v", err)
+		}
+		if dx10.ResourceDimension != ddsDimensionTexture2D {
+			return nil, fmt.Errorf("unsupported DDS resource dimension %d, only 2D textures are supported", dx10.ResourceDimension)
+		}
+		if dx10.ArraySize != 1 {
+			return nil, fmt.Errorf("texture arrays are not supported (array size %d)", dx10.ArraySize)
+		}
+		t.format = dx10.DXGIFormat
+		t.cubemap = dx10.MiscFlag&ddsMiscTextureCube != 0
+		t.dataOffset += 20
+	case pf.Flags&ddsPixelFormatFourCC != 0:
+		format, ok := fourCCFormats[pf.FourCC]
+		if !ok {
+			return nil, fmt.Errorf("unsupported DDS format %q", pf.FourCC[:])
+		}
+		t.format = format
+	case pf.Flags&ddsPixelFormatRGB != 0 && pf.RGBBitCount == 32:
+		switch {
+		case pf.RBitMask == 0xFF && pf.BBitMask == 0xFF0000:
+			t.format = dxgiR8G8B8A8Unorm
+		case pf.RBitMask == 0xFF0000 && pf.BBitMask == 0xFF && pf.ABitMask != 0:
+			t.format = dxgiB8G8R8A8Unorm
+		case pf.RBitMask == 0xFF0000 && pf.BBitMask == 0xFF:
+			t.format = dxgiB8G8R8X8Unorm
+		default:
+			return nil, fmt.Errorf("unsupported DDS RGB masks")
+		}
+	case pf.Flags&ddsPixelFormatLuminance != 0 && pf.RGBBitCount == 8:
+		t.format = dxgiR8Unorm
+	default:
+		return nil, fmt.Errorf("unsupported DDS pixel format")
+	}
+	if _, ok := dxgiFormats[t.format]; !ok {
+		return nil, fmt.Errorf("unsupported DXGI format %d", t.format)
+	}
+
+	// Cubemaps with a DX10 header always have all faces
+	if t.cubemap && !hasDX10Header && header.Caps2&ddsCaps2AllFaces != ddsCaps2AllFaces {
+		return nil, fmt.Errorf("cubemaps without all faces are not supported")
+	}
+	return &t, nil
+}
+
+// faces returns the number of faces of the texture, 6 for cubemaps
+func (t *ddsTexture) faces() int64 {
+	if t.cubemap {
+		return 6
+	}
+	return 1
+}
+
+// mipSize returns the size of the mipmap i of a single face, in bytes
+func (t *ddsTexture) mipSize(i uint32) int64 {
+	width, height := int64(t.width>>i), int64(t.height>>i)
+	if width == 0 {
+		width = 1
+	}
+	if height == 0 {
+		height = 1
+	}
+	info := dxgiFormats[t.format]
+	if info.blockCompressed {
+		return (width + 3) / 4 * ((height + 3) / 4) * info.size
+	}
+	return width * height * info.size
+}
+
+// dataSize returns the size of the pixel data of all faces and mipmaps, in bytes
+func (t *ddsTexture) dataSize() int64 {
+	var size int64
+	for i := uint32(0); i < t.mipCount; i++ {
+		size += t.mipSize(i)
+	}
+	return size * t.faces()
+}
+
+// header returns the headers of the texture, including the magic.
+// They are rebuilt when reading BA2 texture archives, that don't store them.
+// Formats that can be described by a legacy header don't get a DX10 header.
+func (t *ddsTexture) header() []byte {
+	info := dxgiFormats[t.format]
+	header := ddsHeader{
+		Size:        ddsHeaderSize,
+		Flags:       ddsFlagsRequired,
+		Height:      t.height,
+		Width:       t.width,
+		MipMapCount: t.mipCount,
+		Caps:        ddsCapsTexture,
+	}
+	if info.blockCompressed {
+		header.Flags |= ddsFlagsLinearSize
+		header.PitchOrLinearSize = uint32(t.mipSize(0))
+	} else {
+		header.Flags |= ddsFlagsPitch
+		header.PitchOrLinearSize = uint32(int64(t.width) * info.size)
+	}
+	if t.mipCount > 1 {
+		header.Caps |= ddsCapsComplex | ddsCapsMipMap
+	}
+	if t.cubemap {
+		header.Caps |= ddsCapsComplex
+		header.Caps2 = ddsCaps2Cubemap | ddsCaps2AllFaces
+	}
+	pf, legacy := legacyPixelFormats[t.format]
+	if !legacy {
+		pf = ddsPixelFormat{Flags: ddsPixelFormatFourCC, FourCC: [4]byte{'D', 'X', '1', '0'}}
+	}
+	pf.Size = 32
+	header.PixelFormat = pf
+
+	// Writes to a bytes.Buffer don't fail
+	var buf bytes.Buffer
+	buf.Write(ddsMagic[:])
+	binary.Write(&buf, binary.LittleEndian, header)
+	if !legacy {
+		dx10 := ddsHeaderDX10{
+			DXGIFormat:        t.format,
+			ResourceDimension: ddsDimensionTexture2D,
+			ArraySize:         1,
+		}
+		if t.cubemap {
+			dx10.MiscFlag = ddsMiscTextureCube
+		}
+		binary.Write(&buf, binary.LittleEndian, dx10)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,183 @@
+package bsa
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// DiffKind represents the kind of difference of a file between two archives
+type DiffKind int
+
+const (
+	// Added means that the file is present only in the second archive
+	Added DiffKind = iota
+
+	// Removed means that the file is present only in the first archive
+	Removed
+
+	// Changed means that the file content is different
+	Changed
+
+	// Recompressed means that the file content is the same, but it's stored
+	// compressed in one archive and uncompressed in the other one.
+	// It's never reported for loose files.
+	Recompressed
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case Added:
+		return "+"
+	case Removed:
+		return "-"
+	case Changed:
+		return "~"
+	case Recompressed:
+		return "c"
+	}
+	return "?"
+}
+
+// FileDiff represents a file that is different between two archives
+type FileDiff struct {
+	Path string
+	Kind DiffKind
+}
+
+func (d FileDiff) String() string {
+	return fmt.Sprintf("%s %s", d.Kind, d.Path)
+}
+
+// files returns all the files in root, by path
+func (r *Root) files() map[string]*File {
+	result := make(map[string]*File)
+	for _, folder := range r.Folders() {
+		for _, f := range folder.files {
+			result[f.Path()] = f
+		}
+	}
+	return result
+}
+
+// DiffFiles compares the files in a and b by their content.
+// The result is sorted by path.
+func DiffFiles(a *Root, b *Root) ([]FileDiff, error) {
+	var result []FileDiff
+	aFiles, bFiles := a.files(), b.files()
+	for p, aFile := range aFiles {
+		bFile, ok := bFiles[p]
+		if !ok {
+			result = append(result, FileDiff{p, Removed})
+			continue
+		}
+		same, err := sameContent(aFile, bFile)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			result = append(result, FileDiff{p, Changed})
+		} else if aFile.archive != nil && bFile.archive != nil && aFile.Compressed != bFile.Compressed {
+			result = append(result, FileDiff{p, Recompressed})
+		}
+	}
+	for p := range bFiles {
+		if _, ok := aFiles[p]; !ok {
+			result = append(result, FileDiff{p, Added})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result, nil
+}
+
+// DiffHeaders compares the headers of a and b.
+// It returns a description of each difference.
+func DiffHeaders(a *Bsa, b *Bsa) []string {
+	var result []string
+	if a.Version != b.Version {
+		result = append(result, fmt.Sprintf("version: %s -> %s", a.Version, b.Version))
+	}
+	if added := b.ArchiveFlags &^ a.ArchiveFlags; added != 0 {
+		result = append(result, fmt.Sprintf("archive flags added: %s", added))
+	}
+	if removed := a.ArchiveFlags &^ b.ArchiveFlags; removed != 0 {
+		result = append(result, fmt.Sprintf("archive flags removed: %s", removed))
+	}
+	if a.FileFlags != b.FileFlags {
+		result = append(result, fmt.Sprintf("file flags: %#x -> %#x", uint32(a.FileFlags), uint32(b.FileFlags)))
+	}
+	if a.FolderCount != b.FolderCount {
+		result = append(result, fmt.Sprintf("folders: %d -> %d", a.FolderCount, b.FolderCount))
+	}
+	if a.FileCount != b.FileCount {
+		result = append(result, fmt.Sprintf("files: %d -> %d", a.FileCount, b.FileCount))
+	}
+	return result
+}
+
+// sameContent returns true if a and b have the same uncompressed content
+func sameContent(a *File, b *File) (bool, error) {
+	if a.Size != b.Size {
+		return false, nil
+	}
+	aHash, err := contentHash(a)
+	if err != nil {
+		return false, err
+	}
+	bHash, err := contentHash(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aHash, bHash), nil
+}
+
+// contentHash returns the sha256 of the uncompressed content of f
+func contentHash(f *File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %v", f.Path(), err)
+	}
+	return h.Sum(nil), nil
+}
+
+// NewLooseRoot returns a Root containing all the files in the subfolders of dir.
+// Paths inside the archive are relative to dir. Files directly inside dir cannot
+// be in an archive, so they are skipped and their paths returned.
+func NewLooseRoot(dir string) (*Root, []string, error) {
+	root := NewRoot()
+	var skipped []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if filepath.Dir(rel) == "." {
+			skipped = append(skipped, p)
+			return nil
+		}
+		f, err := NewLooseFile(p)
+		if err != nil {
+			return err
+		}
+		return root.AddFile(rel, f)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot walk folder %s: %v", dir, err)
+	}
+	return root, skipped, nil
+}
@@ -0,0 +1,29 @@
+package bsa
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewLooseRootSkipsTopLevelFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "meshes"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"meta.ini", "MyMod.esp", filepath.Join("meshes", "foo.nif")} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, skipped, err := NewLooseRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.FileCount() != 1 || root.Folder("meshes").File("foo.nif") == nil {
+		t.Errorf("expected only meshes\\foo.nif, found %d files", root.FileCount())
+	}
+	if len(skipped) != 2 {
+		t.Errorf("expected 2 skipped files, got %v", skipped)
+	}
+}
@@ -0,0 +1,531 @@
+package bsa
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/xnyo/papy/bsa/flags"
+)
+
+const (
+	// dx10RecordSize is the size of a texture record in BA2 texture archives, excluding its chunks
+	dx10RecordSize = 24
+
+	// dx10ChunkSize is the size of a chunk record in BA2 texture archives
+	dx10ChunkSize = 24
+
+	// dx10MaxChunks is the maximum number of chunks a texture is split into
+	dx10MaxChunks = 4
+
+	// dx10SplitDimension is the minimum width or height of a mipmap to be stored in its own chunk.
+	// Smaller mipmaps are stored together in the last chunk.
+	dx10SplitDimension = 512
+
+	// dx10Flags is the value of the flags field of the texture records in official archives
+	dx10Flags = 0x800
+
+	// dx10Cubemap is set in the flags field of the texture records of cubemaps
+	dx10Cubemap = 0x1
+)
+
+// ba2Textures is the type of BA2 archives that contain DDS textures
+var ba2Textures = [4]byte{'D', 'X', '1', '0'}
+
+// dx10Record represents a texture record in BA2 texture archives.
+// It's followed by the records of its chunks.
+type dx10Record struct {
+	NameHash        uint32
+	Ext             [4]byte
+	DirHash         uint32
+	Unknown         uint8
+	ChunkCount      uint8
+	ChunkHeaderSize uint16
+	Height          uint16
+	Width           uint16
+	MipCount        uint8
+	Format          uint8
+	Flags           uint16
+}
+
+// dx10Chunk represents a chunk record in BA2 texture archives.
+// Each chunk contains one or more mipmaps, without the DDS headers.
+type dx10Chunk struct {
+	Offset uint64
+
+	// PackedSize is the size of the zlib compressed data, or 0 if the chunk is not compressed
+	PackedSize   uint32
+	UnpackedSize uint32
+	StartMip     uint16
+	EndMip       uint16
+	Sentinel     uint32
+}
+
+// storedSize returns the size of the data of the chunk in the archive
+func (c *dx10Chunk) storedSize() uint32 {
+	if c.PackedSize != 0 {
+		return c.PackedSize
+	}
+	return c.UnpackedSize
+}
+
+// dx10Texture contains the records of a texture read from a BA2 texture archive
+type dx10Texture struct {
+	record dx10Record
+	chunks []dx10Chunk
+}
+
+// texture returns the information of the texture stored in its record
+func (t *dx10Texture) texture() *ddsTexture {
+	texture := ddsTexture{
+		width:    uint32(t.record.Width),
+		height:   uint32(t.record.Height),
+		mipCount: uint32(t.record.MipCount),
+		format:   uint32(t.record.Format),
+		cubemap:  t.record.Flags&dx10Cubemap != 0,
+	}
+	if texture.mipCount == 0 {
+		texture.mipCount = 1
+	}
+	texture.dataOffset = int64(len(texture.header()))
+	return &texture
+}
+
+// fileRecord returns a file record with the hashes of the texture and the offset of its first chunk
+func (t *dx10Texture) fileRecord() ba2Record {
+	return ba2Record{
+		NameHash: t.record.NameHash,
+		Ext:      t.record.Ext,
+		DirHash:  t.record.DirHash,
+		Offset:   t.chunks[0].Offset,
+		Sentinel: ba2RecordSentinel,
+	}
+}
+
+// setSizes sets the size of file to the size of the rebuilt DDS file,
+// and its stored size to the size of all its chunks
+func (t *dx10Texture) setSizes(file *File) {
+	file.Size = uint32(t.texture().dataOffset)
+	file.StoredSize = 0
+	file.Compressed = false
+	for _, chunk := range t.chunks {
+		file.Size += chunk.UnpackedSize
+		file.StoredSize += chunk.storedSize()
+		file.Compressed = file.Compressed || chunk.PackedSize != 0
+	}
+}
+
+// mipChunk represents a range of mipmaps stored in the same chunk
+type mipChunk struct {
+	startMip uint32
+	endMip   uint32
+
+	// offset is the offset of the first mipmap, relative to the start of the pixel data
+	offset int64
+	size   int64
+}
+
+// chunks splits the mipmaps of the texture into chunks.
+// The biggest mipmaps are stored in their own chunk, so the game can stream them,
+// the other ones are stored together in the last chunk. Cubemaps are never split.
+func (t *ddsTexture) chunks() []mipChunk {
+	if t.cubemap {
+		return []mipChunk{{0, t.mipCount - 1, 0, t.dataSize()}}
+	}
+	var chunks []mipChunk
+	var offset int64
+	tail := false
+	for i := uint32(0); i < t.mipCount; i++ {
+		size := t.mipSize(i)
+		big := t.width>>i >= dx10SplitDimension || t.height>>i >= dx10SplitDimension
+		if len(chunks) == 0 || (big || !tail) && len(chunks) < dx10MaxChunks {
+			chunks = append(chunks, mipChunk{i, i, offset, size})
+			tail = !big
+		} else {
+			chunks[len(chunks)-1].endMip = i
+			chunks[len(chunks)-1].size += size
+		}
+		offset += size
+	}
+	return chunks
+}
+
+// checkTexture makes sure that a texture can be packed in a BA2 texture archive.
+// The size of the file must be the size of the headers and the pixel data, or data would be lost.
+func checkTexture(file *File, t *ddsTexture, size int64) error {
+	if t.width > 0xFFFF || t.height > 0xFFFF || t.mipCount > 0xFF {
+		return fmt.Errorf("texture %s is too big (%dx%d, %d mipmaps)", file.Path(), t.width, t.height, t.mipCount)
+	}
+	expected := t.dataOffset + t.dataSize()
+	if size < expected {
+		return fmt.Errorf("texture %s is truncated (%d bytes, expected %d)", file.Path(), size, expected)
+	}
+	if size > expected {
+		return fmt.Errorf("texture %s has %d unexpected bytes after its data", file.Path(), size-expected)
+	}
+	return nil
+}
+
+// readTextureHeader reads the DDS headers of a file that will be packed
+func readTextureHeader(file *File) (*ddsTexture, error) {
+	in, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %v", file.Path(), err)
+	}
+	defer in.Close()
+	t, err := readDDSHeader(in)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read texture %s: %v", file.Path(), err)
+	}
+	if err := checkTexture(file, t, int64(file.Size)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// packTexture reads a texture and compresses each one of its chunks, if it must be compressed.
+// Chunks that are not compressed are streamed from the source, only the headers are read.
+func (w *Writer) packTexture(file *File) *packedData {
+	if !w.compressed(file) {
+		t, err := readTextureHeader(file)
+		if err != nil {
+			return &packedData{err: err}
+		}
+		var packed packedData
+		for _, chunk := range t.chunks() {
+			packed.chunks = append(packed.chunks, streamed(t.dataOffset+chunk.offset, chunk.size))
+		}
+		return &packed
+	}
+	data, err := readFileData(file)
+	if err != nil {
+		return &packedData{err: err}
+	}
+	t, err := readDDSHeader(bytes.NewReader(data))
+	if err != nil {
+		return &packedData{err: fmt.Errorf("cannot read texture %s: %v", file.Path(), err)}
+	}
+	if err := checkTexture(file, t, int64(len(data))); err != nil {
+		return &packedData{err: err}
+	}
+	var packed packedData
+	for _, chunk := range t.chunks() {
+		start := t.dataOffset + chunk.offset
+		chunkData := data[start : start+chunk.size]
+		packedChunk := w.compressData(file, chunkData)
+		if packedChunk.err != nil {
+			return packedChunk
+		}
+		packed.chunks = append(packed.chunks, packedChunk)
+	}
+	return &packed
+}
+
+// writeDX10Records writes the header and the texture records, each one followed by its chunks
+func writeDX10Records(out io.Writer, header ba2Header, records []dx10Record, chunks [][]dx10Chunk) error {
+	buf := bufio.NewWriter(out)
+	if err := binary.Write(buf, binary.LittleEndian, header); err != nil {
+		return fmt.Errorf("cannot write header: %v", err)
+	}
+	for i := range records {
+		if err := binary.Write(buf, binary.LittleEndian, records[i]); err != nil {
+			return fmt.Errorf("cannot write texture records: %v", err)
+		}
+		if err := binary.Write(buf, binary.LittleEndian, chunks[i]); err != nil {
+			return fmt.Errorf("cannot write texture records: %v", err)
+		}
+	}
+	return buf.Flush()
+}
+
+// writeDX10 writes the DDS textures in root to out, as a BA2 texture archive.
+// The DDS headers are replaced by the texture records, and the mipmaps are split in chunks.
+// Like the other archives, file data is streamed and the records are patched afterwards.
+func (w *Writer) writeDX10(out io.WriteSeeker, root *Root) error {
+	folders, files, err := ba2Files(root)
+	if err != nil {
+		return err
+	}
+
+	// The number of chunks of each texture must be known before writing the records
+	textures := make([]*ddsTexture, len(files))
+	for i, file := range files {
+		textures[i], err = readTextureHeader(file)
+		if err != nil {
+			return err
+		}
+	}
+	start, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	// Header and texture records.
+	// Offsets, compressed sizes and the name table offset are not known yet, they will be patched later.
+	header := ba2Header{
+		Magic:     ba2Magic,
+		Version:   uint32(flags.Fallout4),
+		Type:      ba2Textures,
+		FileCount: uint32(len(files)),
+	}
+	records := make([]dx10Record, len(files))
+	chunks := make([][]dx10Chunk, len(files))
+	offset := int64(ba2HeaderSize)
+	for i, file := range files {
+		t := textures[i]
+		nameHash, ext, dirHash := ba2FileHashes(file)
+		mipChunks := t.chunks()
+		records[i] = dx10Record{
+			NameHash:        nameHash,
+			Ext:             ext,
+			DirHash:         dirHash,
+			ChunkCount:      uint8(len(mipChunks)),
+			ChunkHeaderSize: dx10ChunkSize,
+			Height:          uint16(t.height),
+			Width:           uint16(t.width),
+			MipCount:        uint8(t.mipCount),
+			Format:          uint8(t.format),
+			Flags:           dx10Flags,
+		}
+		if t.cubemap {
+			records[i].Flags |= dx10Cubemap
+		}
+		for _, c := range mipChunks {
+			chunks[i] = append(chunks[i], dx10Chunk{
+				UnpackedSize: uint32(c.size),
+				StartMip:     uint16(c.startMip),
+				EndMip:       uint16(c.endMip),
+				Sentinel:     ba2RecordSentinel,
+			})
+		}
+		offset += dx10RecordSize + int64(len(mipChunks))*dx10ChunkSize
+	}
+	buf := bufio.NewWriter(out)
+	if err := writeDX10Records(buf, header, records, chunks); err != nil {
+		return err
+	}
+
+	// Chunk data
+	done := make(chan struct{})
+	defer close(done)
+	queue := w.compressFiles(folders, done)
+	for i, file := range files {
+		packed := queue.next()
+		if packed.err != nil {
+			return packed.err
+		}
+		if len(packed.chunks) != len(chunks[i]) {
+			return fmt.Errorf("texture %s changed while packing", file.Path())
+		}
+		for j, chunk := range packed.chunks {
+			size, err := writePackedData(buf, file, chunk)
+			if err != nil {
+				return err
+			}
+			chunks[i][j].Offset = uint64(offset)
+			if chunk.compressed {
+				chunks[i][j].PackedSize = size
+			}
+			offset += int64(size)
+		}
+	}
+
+	// Name table
+	header.NameTableOffset = uint64(offset)
+	size, err := writeBA2NameTable(buf, files)
+	if err != nil {
+		return err
+	}
+	offset += size
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+
+	// Patch the header and the texture records
+	if _, err := out.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	if err := writeDX10Records(out, header, records, chunks); err != nil {
+		return err
+	}
+	_, err = out.Seek(start+offset, io.SeekStart)
+	return err
+}
+
+// isDX10 returns true if the archive is a BA2 texture archive
+func (b *Bsa) isDX10() bool {
+	return b.dx10Textures != nil
+}
+
+// readDX10Records reads the texture records of a BA2 texture archive, each one followed by its chunks
+func (b *Bsa) readDX10Records(count uint32) ([]*dx10Texture, error) {
+	if err := b.checkCount("file", uint64(count), dx10RecordSize, ba2HeaderSize); err != nil {
+		return nil, err
+	}
+	var textures []*dx10Texture
+	offset := int64(ba2HeaderSize)
+	in := bufio.NewReader(io.NewSectionReader(b.r, ba2HeaderSize, 1<<62))
+	for i := uint32(0); i < count; i++ {
+		var t dx10Texture
+		if err := binary.Read(in, binary.LittleEndian, &t.record); err != nil {
+			return nil, fmt.Errorf("cannot read texture record %d: %v", i, err)
+		}
+		if t.record.ChunkCount == 0 {
+			return nil, fmt.Errorf("texture record %d has no chunks", i)
+		}
+		if t.record.ChunkHeaderSize != dx10ChunkSize {
+			return nil, fmt.Errorf("texture record %d: unsupported chunk record size %d", i, t.record.ChunkHeaderSize)
+		}
+		t.chunks = make([]dx10Chunk, t.record.ChunkCount)
+		if err := binary.Read(in, binary.LittleEndian, t.chunks); err != nil {
+			return nil, fmt.Errorf("cannot read chunk records of texture %d: %v", i, err)
+		}
+		textures = append(textures, &t)
+		offset += dx10RecordSize + int64(len(t.chunks))*dx10ChunkSize
+	}
+	b.dataStart = offset
+	return textures, nil
+}
+
+// textureReader reads a texture rebuilt from its headers and chunks
+type textureReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close closes the decompressors of the chunks
+func (r *textureReader) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// openTexture opens a texture of a BA2 texture archive.
+// The DDS headers are rebuilt from the texture record, followed by the data of each chunk.
+func (b *Bsa) openTexture(f *File, t *dx10Texture) (io.ReadCloser, error) {
+	r := &textureReader{}
+	readers := []io.Reader{bytes.NewReader(t.texture().header())}
+	for i := range t.chunks {
+		chunk := &t.chunks[i]
+		data := io.NewSectionReader(b.r, int64(chunk.Offset), int64(chunk.storedSize()))
+		if chunk.PackedSize == 0 {
+			readers = append(readers, data)
+			continue
+		}
+		d, err := decompressor(b.Version, data)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("cannot decompress %s: %v", f.Path(), err)
+		}
+		readers = append(readers, d)
+		r.closers = append(r.closers, d)
+	}
+	r.Reader = io.MultiReader(readers...)
+	return r, nil
+}
+
+// verifyDX10Chunks checks that the chunks of the textures contain all their mipmaps, that they
+// are within bounds and not overlapping and that compressed chunks have the declared size
+func (b *Bsa) verifyDX10Chunks() []error {
+	type fileChunk struct {
+		file  *File
+		index int
+		chunk *dx10Chunk
+	}
+	var errs []error
+	var chunks []fileChunk
+	for _, folder := range b.folders {
+		for _, f := range folder.files {
+			t := b.dx10Textures[f]
+			errs = append(errs, t.verifyMips(f)...)
+			for i := range t.chunks {
+				chunks = append(chunks, fileChunk{f, i, &t.chunks[i]})
+			}
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].chunk.Offset < chunks[j].chunk.Offset })
+	for i, c := range chunks {
+		start, end := int64(c.chunk.Offset), int64(c.chunk.Offset)+int64(c.chunk.storedSize())
+		if c.chunk.Sentinel != ba2RecordSentinel {
+			errs = append(errs, fmt.Errorf("file %s: chunk %d: invalid sentinel %08x", c.file.Path(), c.index, c.chunk.Sentinel))
+		}
+		if start < b.dataStart {
+			errs = append(errs, fmt.Errorf("file %s: chunk %d: data offset %d overlaps the records", c.file.Path(), c.index, start))
+			continue
+		}
+		if b.size >= 0 && end > b.size {
+			errs = append(errs, fmt.Errorf("file %s: chunk %d: data ends at %d, after the end of the archive (%d)", c.file.Path(), c.index, end, b.size))
+			continue
+		}
+		if b.nameTableOffset != 0 && end > b.nameTableOffset {
+			errs = append(errs, fmt.Errorf("file %s: chunk %d: data overlaps the name table", c.file.Path(), c.index))
+		}
+		if i > 0 {
+			prev := chunks[i-1]
+			if prevEnd := int64(prev.chunk.Offset) + int64(prev.chunk.storedSize()); prevEnd > start {
+				errs = append(errs, fmt.Errorf("file %s: chunk %d: data overlaps chunk %d of %s", c.file.Path(), c.index, prev.index, prev.file.Path()))
+			}
+		}
+		if c.chunk.PackedSize != 0 {
+			if err := b.verifyChunkDecompression(c.chunk); err != nil {
+				errs = append(errs, fmt.Errorf("file %s: chunk %d: %v", c.file.Path(), c.index, err))
+			}
+		}
+	}
+	return errs
+}
+
+// verifyMips checks that the chunks of a texture contain all its mipmaps, in order,
+// and that their size is the size of their mipmaps
+func (t *dx10Texture) verifyMips(f *File) []error {
+	texture := t.texture()
+	if _, ok := dxgiFormats[texture.format]; !ok {
+		return []error{fmt.Errorf("file %s: unsupported DXGI format %d", f.Path(), texture.format)}
+	}
+	var errs []error
+	next := uint32(0)
+	for i, chunk := range t.chunks {
+		start, end := uint32(chunk.StartMip), uint32(chunk.EndMip)
+		if start != next || end < start || end >= texture.mipCount {
+			errs = append(errs, fmt.Errorf("file %s: chunk %d: mipmaps %d-%d, expected to start from %d and end before %d", f.Path(), i, start, end, next, texture.mipCount))
+			return errs
+		}
+		var size int64
+		for mip := start; mip <= end; mip++ {
+			size += texture.mipSize(mip)
+		}
+		if size *= texture.faces(); int64(chunk.UnpackedSize) != size {
+			errs = append(errs, fmt.Errorf("file %s: chunk %d: size is %d, expected %d", f.Path(), i, chunk.UnpackedSize, size))
+		}
+		next = end + 1
+	}
+	if next != texture.mipCount {
+		errs = append(errs, fmt.Errorf("file %s: chunks contain %d mipmaps, expected %d", f.Path(), next, texture.mipCount))
+	}
+	return errs
+}
+
+// verifyChunkDecompression checks that a compressed chunk decompresses to its declared size
+func (b *Bsa) verifyChunkDecompression(chunk *dx10Chunk) error {
+	r, err := decompressor(b.Version, io.NewSectionReader(b.r, int64(chunk.Offset), int64(chunk.PackedSize)))
+	if err != nil {
+		return fmt.Errorf("cannot decompress: %v", err)
+	}
+	defer r.Close()
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return fmt.Errorf("cannot decompress: %v", err)
+	}
+	if n != int64(chunk.UnpackedSize) {
+		return fmt.Errorf("decompressed size is %d, expected %d", n, chunk.UnpackedSize)
+	}
+	return nil
+}
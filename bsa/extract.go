@@ -0,0 +1,58 @@
+package bsa
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkEntryPath makes sure that a path read from an archive cannot point outside
+// of the folder it's extracted to. Slashes and colons are path separators
+// (or drive letters) on Windows, so they are not allowed either.
+func checkEntryPath(path string) error {
+	if strings.ContainsAny(path, "/:") {
+		return fmt.Errorf("invalid file path %s: it contains slashes or colons", path)
+	}
+	for _, part := range strings.Split(path, "\\") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("invalid file path %s: it contains an empty, . or .. component", path)
+		}
+	}
+	return nil
+}
+
+// ExtractTo extracts the file to dir, restoring its folder structure.
+// It returns the path of the extracted file.
+func (f *File) ExtractTo(dir string) (string, error) {
+	if err := checkEntryPath(f.Path()); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(append([]string{dir}, strings.Split(f.Path(), "\\")...)...)
+	if rel, err := filepath.Rel(dir, dst); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid file path %s: it points outside of %s", f.Path(), dir)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", fmt.Errorf("cannot create folder for %s: %v", dst, err)
+	}
+	in, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", fmt.Errorf("cannot create file %s: %v", dst, err)
+	}
+	n, err := io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return "", fmt.Errorf("cannot extract %s: %v", f.Path(), err)
+	}
+	if n != int64(f.Size) {
+		out.Close()
+		return "", fmt.Errorf("cannot extract %s: expected %d bytes, got %d", f.Path(), f.Size, n)
+	}
+	return dst, out.Close()
+}
@@ -0,0 +1,42 @@
+package bsa
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckEntryPath(t *testing.T) {
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{`meshes\foo\bar.nif`, true},
+		{`meshes\foo..bar\bar.nif`, true},
+		{`meshes\..\..\pw.txt`, false},
+		{`meshes\../../pw.txt`, false},
+		{`meshes\foo/bar.nif`, false},
+		{`meshes\c:pw.txt`, false},
+		{`c:\pw.txt`, false},
+		{`\meshes\bar.nif`, false},
+		{`meshes\\bar.nif`, false},
+		{`meshes\.\bar.nif`, false},
+	}
+	for _, tt := range tests {
+		if err := checkEntryPath(tt.path); (err == nil) != tt.ok {
+			t.Errorf("checkEntryPath(%q) = %v", tt.path, err)
+		}
+	}
+}
+
+func TestExtractToOutside(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "x", "y")
+	f := &File{Node: Node{Name: "../../pw.txt"}, Folder: NewFolder("meshes")}
+	if _, err := f.ExtractTo(out); err == nil {
+		t.Fatal("file extracted outside of the output folder")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "x", "pw.txt")); !os.IsNotExist(err) {
+		t.Fatalf("file extracted outside of the output folder: %v", err)
+	}
+}
@@ -1,6 +1,10 @@
 package flags
 
-import "strings"
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
 
 // ArchiveFlags represents the flags associated to a BSA file
 type ArchiveFlags uint32
@@ -45,10 +49,10 @@ type FileFlags uint32
 
 const (
 	// None ...
-	None = 1 << iota
+	None FileFlags = 0
 
 	// Meshes ...
-	Meshes
+	Meshes FileFlags = 1 << (iota - 1)
 
 	// Textures ...
 	Textures
@@ -75,15 +79,107 @@ const (
 	Miscellaneous
 )
 
+// extFileFlags maps file extensions to their content type
+var extFileFlags = map[string]FileFlags{
+	".nif": Meshes,
+	".kf":  Meshes,
+	".hkx": Meshes,
+	".tri": Meshes,
+	".egm": Meshes,
+	".egt": Meshes,
+	".btr": Meshes,
+	".bto": Meshes,
+	".dds": Textures,
+	".tga": Textures,
+	".png": Textures,
+	".swf": Menus,
+	".wav": Sounds,
+	".xwm": Sounds,
+	".mp3": Sounds,
+	".ogg": Sounds,
+	".fuz": Voices,
+	".lip": Voices,
+	".fxp": Shaders,
+	".spt": Trees,
+	".fnt": Fonts,
+	".tex": Fonts,
+}
+
+// folderFileFlags maps top level folders to the content type of the files they contain.
+// They take precedence over the extension.
+var folderFileFlags = map[string]FileFlags{
+	"meshes":    Meshes,
+	"textures":  Textures,
+	"interface": Menus,
+	"menus":     Menus,
+	"sound":     Sounds,
+	"shaders":   Shaders,
+	"trees":     Trees,
+	"fonts":     Fonts,
+	"scripts":   Miscellaneous,
+}
+
 // ExtToFileFlags returns the FileFlags from a string extension
 // the extension string must be in the format '.xyz' (eg: '.nif')
 func ExtToFileFlags(ext string) FileFlags {
-	extMap := map[string]FileFlags{
-		".nif": Meshes,
-	}
-	v, ok := extMap[strings.ToLower(ext)]
+	v, ok := extFileFlags[strings.ToLower(ext)]
 	if !ok {
 		return Miscellaneous
 	}
 	return v
 }
+
+// PathToFileFlags returns the FileFlags of a file from its path inside the archive.
+// The top level folder determines the content type, and the extension is used
+// if the folder is not a known one (eg: sound/voice/x.fuz is Voices, meshes/x.nif is Meshes).
+// Slashes and backslashes are both valid path separators.
+func PathToFileFlags(path string) FileFlags {
+	path = strings.ToLower(strings.ReplaceAll(path, "/", "\\"))
+	if strings.HasPrefix(path, "sound\\voice\\") {
+		return Voices
+	}
+	if i := strings.Index(path, "\\"); i > 0 {
+		if v, ok := folderFileFlags[path[:i]]; ok {
+			return v
+		}
+	}
+	ext := ""
+	if i := strings.LastIndexAny(path, ".\\"); i >= 0 && path[i] == '.' {
+		ext = path[i:]
+	}
+	return ExtToFileFlags(ext)
+}
+
+// archiveFlagNames maps the names used in project files to archive flags
+var archiveFlagNames = map[string]ArchiveFlags{
+	"include_directory_names":       IncludeDirectoryNames,
+	"include_file_names":            IncludeFileNames,
+	"compressed":                    Compressed,
+	"retain_directory_names":        RetainDirectoryNames,
+	"retain_file_names":             RetainFileNames,
+	"retain_file_names_offsets":     RetainFileNamesOffsets,
+	"xbox360":                       Xbox360,
+	"retain_strings_during_startup": RetainStringsDuringStartup,
+	"embed_file_names":              EmbedFileNames,
+	"xmem":                          XMem,
+}
+
+func (f ArchiveFlags) String() string {
+	var names []string
+	for name, flag := range archiveFlagNames {
+		if f&flag != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, "|")
+}
+
+// ParseArchiveFlag returns the ArchiveFlags from its name (eg: 'embed_file_names')
+func ParseArchiveFlag(name string) (ArchiveFlags, error) {
+	v, ok := archiveFlagNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown archive flag %s", name)
+	}
+	return v, nil
+}
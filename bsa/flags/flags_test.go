@@ -0,0 +1,95 @@
+package flags
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPathToFileFlags(t *testing.T) {
+	tests := []struct {
+		path      string
+		fileFlags FileFlags
+	}{
+		// Extensions, outside of known folders
+		{`data\a.nif`, Meshes},
+		{`data\a.kf`, Meshes},
+		{`data\a.hkx`, Meshes},
+		{`data\a.tri`, Meshes},
+		{`data\a.egm`, Meshes},
+		{`data\a.egt`, Meshes},
+		{`data\a.btr`, Meshes},
+		{`data\a.bto`, Meshes},
+		{`data\a.dds`, Textures},
+		{`data\a.tga`, Textures},
+		{`data\a.png`, Textures},
+		{`data\a.swf`, Menus},
+		{`data\a.wav`, Sounds},
+		{`data\a.xwm`, Sounds},
+		{`data\a.mp3`, Sounds},
+		{`data\a.ogg`, Sounds},
+		{`data\a.fuz`, Voices},
+		{`data\a.lip`, Voices},
+		{`data\a.fxp`, Shaders},
+		{`data\a.spt`, Trees},
+		{`data\a.fnt`, Fonts},
+		{`data\a.tex`, Fonts},
+		{`data\a.pex`, Miscellaneous},
+		{`data\a.NIF`, Meshes},
+		{`data\a`, Miscellaneous},
+		{`data.nif\a`, Miscellaneous},
+		{`a.dds`, Textures},
+
+		// Known top level folders win over the extension
+		{`meshes\a.dds`, Meshes},
+		{`textures\a.nif`, Textures},
+		{`interface\a.txt`, Menus},
+		{`menus\a.txt`, Menus},
+		{`sound\fx\a.fuz`, Sounds},
+		{`shaders\a.txt`, Shaders},
+		{`trees\a.txt`, Trees},
+		{`fonts\a.txt`, Fonts},
+		{`scripts\a.nif`, Miscellaneous},
+		{`MESHES\A.DDS`, Meshes},
+
+		// Voices are in sound\voice
+		{`sound\voice\mymod.esp\a.fuz`, Voices},
+		{`sound\voice\a.wav`, Voices},
+		{`Sound\Voice\a.xwm`, Voices},
+		{`sound\voices\a.wav`, Sounds},
+		{`data\sound\voice\a.wav`, Sounds},
+
+		// Only the top level folder counts
+		{`data\meshes\a.dds`, Textures},
+		{`\meshes\a.dds`, Textures},
+
+		// Slashes are separators too
+		{`meshes/a.dds`, Meshes},
+		{`sound/voice/a.wav`, Voices},
+		{`data/a.png`, Textures},
+	}
+	extensions, folders := make(map[string]bool), make(map[string]bool)
+	for _, tt := range tests {
+		if got := PathToFileFlags(tt.path); got != tt.fileFlags {
+			t.Errorf("PathToFileFlags(%s) = %d, expected %d", tt.path, got, tt.fileFlags)
+		}
+		p := strings.ReplaceAll(tt.path, "/", `\`)
+		if strings.HasPrefix(p, `data\a.`) {
+			extensions[p[len(`data\a`):]] = true
+		}
+		if i := strings.Index(p, `\`); i > 0 {
+			folders[p[:i]] = true
+		}
+	}
+
+	// Every rule is tested
+	for ext := range extFileFlags {
+		if !extensions[ext] {
+			t.Errorf("extension %s not tested", ext)
+		}
+	}
+	for folder := range folderFileFlags {
+		if !folders[folder] {
+			t.Errorf("folder %s not tested", folder)
+		}
+	}
+}
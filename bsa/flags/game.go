@@ -1,12 +1,58 @@
 package flags
 
+import (
+	"fmt"
+	"strings"
+)
+
 // Game represents a game
 type Game uint32
 
 const (
-	// Legendary represents Skyrim Legendary Edition
+	// Fallout4 represents Fallout 4. It's the version of BA2 archives.
+	Fallout4 Game = 1
+
+	// Oblivion represents Oblivion (v103 archives)
+	Oblivion Game = 0x67
+
+	// Legendary represents Skyrim Legendary Edition, Fallout 3 and Fallout New Vegas (v104 archives)
 	Legendary Game = 0x68
 
 	// Special represents Skyrim Special Edition
-	Special = 0x69
+	Special Game = 0x69
 )
+
+// IsValid returns true if papy can write archives for the game
+func (g Game) IsValid() bool {
+	return g == Oblivion || g == Legendary || g == Special || g == Fallout4
+}
+
+func (g Game) String() string {
+	switch g {
+	case Fallout4:
+		return "Fallout 4"
+	case Oblivion:
+		return "Oblivion"
+	case Legendary:
+		return "Skyrim Legendary Edition/Fallout 3/New Vegas"
+	case Special:
+		return "Skyrim Special Edition"
+	}
+	return fmt.Sprintf("unknown game (%#x)", uint32(g))
+}
+
+// ParseGame returns the Game from its name, as used in project files.
+// An empty name defaults to Skyrim Special Edition.
+func ParseGame(name string) (Game, error) {
+	switch strings.ToLower(name) {
+	case "", "sse", "special":
+		return Special, nil
+	case "le", "legendary", "fo3", "fnv":
+		return Legendary, nil
+	case "tes4", "oblivion":
+		return Oblivion, nil
+	case "fo4", "fallout4":
+		return Fallout4, nil
+	}
+	return 0, fmt.Errorf("unknown game %s", name)
+}
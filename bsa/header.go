@@ -0,0 +1,105 @@
+package bsa
+
+import (
+	"math/bits"
+
+	"github.com/xnyo/papy/bsa/flags"
+)
+
+const (
+	// headerSize is the size of the BSA header, in bytes
+	headerSize = 36
+
+	// fileRecordSize is the size of a file record, in bytes
+	fileRecordSize = 16
+
+	// maxFileSize is the maximum size of a file inside an archive.
+	// The two most significant bits of the size field are used as flags.
+	maxFileSize = 1<<30 - 1
+
+	// fileSizeMask masks the size field of a file record, discarding the flags
+	fileSizeMask = 0x3FFFFFFF
+
+	// compressionToggle is set in the size field of a file record if the
+	// file is compressed and the archive is not, or vice versa
+	compressionToggle = 1 << 30
+
+	// maxArchiveSize is the maximum size of an archive.
+	// Data offsets are stored as 32 bits integers.
+	maxArchiveSize = 1<<32 - 1
+)
+
+// magic is the BSA file identifier
+var magic = [4]byte{'B', 'S', 'A', 0}
+
+// Header represents the header of a BSA archive
+type Header struct {
+	// Magic is always "BSA\x00"
+	Magic [4]byte
+
+	// Version is the archive version, that depends on the game
+	Version flags.Game
+
+	// Offset is the offset of the folder records, always 36
+	Offset uint32
+
+	// ArchiveFlags are the archive flags
+	ArchiveFlags flags.ArchiveFlags
+
+	// FolderCount is the number of folders in the archive
+	FolderCount uint32
+
+	// FileCount is the number of files in the archive
+	FileCount uint32
+
+	// TotalFolderNameLength is the total length of all folder names,
+	// including the trailing \0 but not the prefix length byte
+	TotalFolderNameLength uint32
+
+	// TotalFileNameLength is the total length of all file names,
+	// including the trailing \0
+	TotalFileNameLength uint32
+
+	// FileFlags are the flags representing the content type of the archive
+	FileFlags flags.FileFlags
+}
+
+// storedHash converts a hash from or to the byte order used in the records of an archive.
+// Xbox 360 archives store hashes in big endian, everything else is little endian.
+func storedHash(archiveFlags flags.ArchiveFlags, hash uint64) uint64 {
+	if archiveFlags&flags.Xbox360 != 0 {
+		return bits.ReverseBytes64(hash)
+	}
+	return hash
+}
+
+// folderRecordSize returns the size of a folder record, in bytes.
+// Skyrim Special Edition archives use 64 bits offsets.
+func folderRecordSize(version flags.Game) int64 {
+	if version == flags.Special {
+		return 24
+	}
+	return 16
+}
+
+// folderRecord represents a folder record in v104 archives
+type folderRecord struct {
+	Hash   uint64
+	Count  uint32
+	Offset uint32
+}
+
+// folderRecordSE represents a folder record in v105 archives
+type folderRecordSE struct {
+	Hash    uint64
+	Count   uint32
+	Padding uint32
+	Offset  uint64
+}
+
+// fileRecord represents a file record
+type fileRecord struct {
+	Hash   uint64
+	Size   uint32
+	Offset uint32
+}
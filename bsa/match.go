@@ -0,0 +1,20 @@
+package bsa
+
+import (
+	"path"
+	"strings"
+)
+
+// MatchPath returns true if the path of a file inside an archive matches the glob pattern.
+// Both are case insensitive and may contain either slashes or backslashes.
+// Patterns without separators are matched against the file name only,
+// the other ones against the whole path (eg: meshes/*/*.nif)
+func MatchPath(pattern string, p string) bool {
+	pattern = strings.ReplaceAll(SanitizePath(pattern), "\\", "/")
+	p = strings.ReplaceAll(SanitizePath(p), "\\", "/")
+	if !strings.Contains(pattern, "/") {
+		p = path.Base(p)
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
@@ -0,0 +1,342 @@
+package bsa
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/xnyo/papy/bsa/flags"
+)
+
+// Bsa represents a BSA or BA2 archive read from a file or an io.ReaderAt.
+// Use Open or Read to instantiate a Bsa struct
+type Bsa struct {
+	Header
+
+	// Root is the root of the archive, containing all its folders and files
+	Root *Root
+
+	// folders are the folders in the same order they are stored in the archive
+	folders []*Folder
+
+	// folderOffsets are the offsets stored in the folder records
+	folderOffsets []uint64
+
+	// blockOffsets are the actual offsets of the file record blocks
+	blockOffsets []int64
+
+	// dataStart is the offset of the end of the records and names
+	dataStart int64
+
+	// size is the size of the archive in bytes, or -1 if it's not known
+	size int64
+
+	// nameTableOffset is the offset of the name table of BA2 archives, or 0 if it's missing
+	nameTableOffset int64
+
+	// ba2Records are the records of the files of BA2 archives
+	ba2Records map[*File]*ba2Record
+
+	// dx10Textures are the texture and chunk records of the files of BA2 texture archives
+	dx10Textures map[*File]*dx10Texture
+
+	r      io.ReaderAt
+	closer io.Closer
+}
+
+// Open opens the BSA or BA2 archive at path.
+// File data is read lazily, so the archive must be closed with Close when done.
+func Open(path string) (*Bsa, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open archive %s: %v", path, err)
+	}
+	s, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot stat archive %s: %v", path, err)
+	}
+	b, err := Read(io.NewSectionReader(f, 0, s.Size()))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot read archive %s: %v", path, err)
+	}
+	b.closer = f
+	return b, nil
+}
+
+// Read parses the BSA or BA2 archive from r.
+// File data is not read, it will be read from r when opening each file.
+func Read(r io.ReaderAt) (*Bsa, error) {
+	b := Bsa{
+		Root: NewRoot(),
+		size: -1,
+		r:    r,
+	}
+	if sized, ok := r.(interface{ Size() int64 }); ok {
+		b.size = sized.Size()
+	}
+	var fileMagic [4]byte
+	if _, err := r.ReadAt(fileMagic[:], 0); err != nil {
+		return nil, fmt.Errorf("cannot read header: %v", err)
+	}
+	if fileMagic == ba2Magic {
+		if err := b.readBA2(); err != nil {
+			return nil, err
+		}
+		return &b, nil
+	}
+	if err := binary.Read(io.NewSectionReader(r, 0, headerSize), binary.LittleEndian, &b.Header); err != nil {
+		return nil, fmt.Errorf("cannot read header: %v", err)
+	}
+	if b.Magic != magic {
+		return nil, fmt.Errorf("not a BSA archive")
+	}
+	if b.Version != flags.Oblivion && b.Version != flags.Legendary && b.Version != flags.Special {
+		return nil, fmt.Errorf("unsupported archive version %#x", uint32(b.Version))
+	}
+
+	// Records are read sequentially, starting from the folder records
+	in := bufio.NewReader(io.NewSectionReader(r, int64(b.Offset), 1<<62))
+
+	// Folder records
+	type folderInfo struct {
+		hash  uint64
+		count uint32
+	}
+	if err := b.checkCount("folder", uint64(b.FolderCount), folderRecordSize(b.Version), int64(b.Offset)); err != nil {
+		return nil, err
+	}
+	if err := b.checkCount("file", uint64(b.FileCount), fileRecordSize, int64(b.Offset)+int64(b.FolderCount)*folderRecordSize(b.Version)); err != nil {
+		return nil, err
+	}
+	var folderInfos []folderInfo
+	for i := uint32(0); i < b.FolderCount; i++ {
+		if b.Version == flags.Special {
+			var record folderRecordSE
+			if err := binary.Read(in, binary.LittleEndian, &record); err != nil {
+				return nil, fmt.Errorf("cannot read folder record %d: %v", i, err)
+			}
+			folderInfos = append(folderInfos, folderInfo{storedHash(b.ArchiveFlags, record.Hash), record.Count})
+			b.folderOffsets = append(b.folderOffsets, record.Offset)
+		} else {
+			var record folderRecord
+			if err := binary.Read(in, binary.LittleEndian, &record); err != nil {
+				return nil, fmt.Errorf("cannot read folder record %d: %v", i, err)
+			}
+			folderInfos = append(folderInfos, folderInfo{storedHash(b.ArchiveFlags, record.Hash), record.Count})
+			b.folderOffsets = append(b.folderOffsets, uint64(record.Offset))
+		}
+	}
+
+	// File record blocks
+	var files []*File
+	seen := make(map[*Folder]struct{})
+	offset := int64(b.Offset) + int64(b.FolderCount)*folderRecordSize(b.Version)
+	for i, info := range folderInfos {
+		b.blockOffsets = append(b.blockOffsets, offset)
+		name := fmt.Sprintf("%016x", info.hash)
+		if b.ArchiveFlags&flags.IncludeDirectoryNames != 0 {
+			s, length, err := readBZString(in)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read folder name %d: %v", i, err)
+			}
+			name = s
+			offset += 1 + int64(length)
+		}
+		offset += int64(info.count) * fileRecordSize
+		folder := b.Root.Folder(name)
+		if _, ok := seen[folder]; ok {
+			return nil, fmt.Errorf("folder %s is present multiple times", name)
+		}
+		seen[folder] = struct{}{}
+		b.folders = append(b.folders, folder)
+		hash := info.hash
+		folder.tesHash = &hash
+		for j := uint32(0); j < info.count; j++ {
+			var record fileRecord
+			if err := binary.Read(in, binary.LittleEndian, &record); err != nil {
+				return nil, fmt.Errorf("cannot read file record %d in folder %s: %v", j, name, err)
+			}
+			hash := storedHash(b.ArchiveFlags, record.Hash)
+			file := &File{
+				Node: Node{
+					Name:    fmt.Sprintf("%016x", hash),
+					tesHash: &hash,
+				},
+				Offset:     uint64(record.Offset),
+				StoredSize: record.Size & fileSizeMask,
+				Compressed: (b.ArchiveFlags&flags.Compressed != 0) != (record.Size&compressionToggle != 0),
+				Folder:     folder,
+				archive:    &b,
+			}
+			files = append(files, file)
+		}
+	}
+	if uint32(len(files)) != b.FileCount {
+		return nil, fmt.Errorf("expected %d files, found %d", b.FileCount, len(files))
+	}
+
+	// File names
+	if b.ArchiveFlags&flags.IncludeFileNames != 0 {
+		names, err := ioutil.ReadAll(io.LimitReader(in, int64(b.TotalFileNameLength)))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read file names: %v", err)
+		}
+		if len(names) != int(b.TotalFileNameLength) {
+			return nil, fmt.Errorf("cannot read file names: %v", io.ErrUnexpectedEOF)
+		}
+		for i, file := range files {
+			end := bytes.IndexByte(names, 0)
+			if end < 0 {
+				return nil, fmt.Errorf("expected %d file names, found %d", len(files), i)
+			}
+			// Names are looked up sanitized, like the paths of the files added to a Root
+			file.Name = SanitizePath(string(names[:end]))
+			names = names[end+1:]
+		}
+		offset += int64(b.TotalFileNameLength)
+	}
+	b.dataStart = offset
+
+	// Files are added to their folders only when their names are known
+	for _, file := range files {
+		if err := checkEntryPath(file.Path()); err != nil {
+			return nil, err
+		}
+		file.Folder.AddFile(file)
+	}
+
+	// Uncompressed sizes
+	for _, file := range files {
+		size, err := b.fileSize(file)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read size of %s: %v", file.Path(), err)
+		}
+		file.Size = size
+	}
+	return &b, nil
+}
+
+// checkCount makes sure that count records of recordSize bytes, starting at offset,
+// fit in the archive. Counts are read from the header, so corrupted archives
+// are reported before allocating memory for their records.
+// Nothing is checked if the size of the archive is not known.
+func (b *Bsa) checkCount(what string, count uint64, recordSize int64, offset int64) error {
+	if b.size < 0 {
+		return nil
+	}
+	if offset > b.size || count > uint64((b.size-offset)/recordSize) {
+		return fmt.Errorf("%s count %d is too big for an archive of %d bytes", what, count, b.size)
+	}
+	return nil
+}
+
+// Close closes the underlying archive file, if the archive was opened with Open
+func (b *Bsa) Close() error {
+	if b.closer == nil {
+		return nil
+	}
+	return b.closer.Close()
+}
+
+// Hashes returns the folder and file hashes of a file read from this archive,
+// as stored in its records. BA2 archives use 32 bits hashes.
+func (b *Bsa) Hashes(f *File) (uint64, uint64) {
+	if record, ok := b.ba2Records[f]; ok {
+		return uint64(record.DirHash), uint64(record.NameHash)
+	}
+	return f.Folder.TesHash(), f.TesHash()
+}
+
+// embedFileNames returns true if the full file path is written before each file data.
+// The flag has a different meaning in v103 archives.
+func (b *Bsa) embedFileNames() bool {
+	return b.Version != flags.Oblivion && b.ArchiveFlags&flags.EmbedFileNames != 0
+}
+
+// dataOffset returns the offset and the size of the actual file data
+// (after the embedded name) of a file read from this archive
+func (b *Bsa) dataOffset(f *File) (int64, int64, error) {
+	offset, size := int64(f.Offset), int64(f.StoredSize)
+	if b.embedFileNames() {
+		var nameLength [1]byte
+		if _, err := b.r.ReadAt(nameLength[:], offset); err != nil {
+			return 0, 0, err
+		}
+		offset += 1 + int64(nameLength[0])
+		size -= 1 + int64(nameLength[0])
+	}
+	if size < 0 {
+		return 0, 0, fmt.Errorf("embedded name is bigger than the file data")
+	}
+	return offset, size, nil
+}
+
+// fileSize returns the uncompressed size of a file read from this archive
+func (b *Bsa) fileSize(f *File) (uint32, error) {
+	offset, size, err := b.dataOffset(f)
+	if err != nil {
+		return 0, err
+	}
+	if f.Compressed {
+		// Compressed data is prefixed by the original size
+		var originalSize [4]byte
+		if _, err := b.r.ReadAt(originalSize[:], offset); err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint32(originalSize[:]), nil
+	}
+	return uint32(size), nil
+}
+
+// openFile opens the data of a file read from this archive.
+// Compressed files are decompressed on the fly, textures of BA2 texture archives are rebuilt from their chunks.
+func (b *Bsa) openFile(f *File) (io.ReadCloser, error) {
+	if t, ok := b.dx10Textures[f]; ok {
+		return b.openTexture(f, t)
+	}
+	offset, size, err := b.dataOffset(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %v", f.Path(), err)
+	}
+	if !f.Compressed {
+		return ioutil.NopCloser(io.NewSectionReader(b.r, offset, size)), nil
+	}
+	if b.isBA2() {
+		// The original size is in the file record
+		r, err := decompressor(b.Version, io.NewSectionReader(b.r, offset, size))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decompress %s: %v", f.Path(), err)
+		}
+		return r, nil
+	}
+
+	// Skip the original size
+	if size < 4 {
+		return nil, fmt.Errorf("cannot read %s: compressed data is too small", f.Path())
+	}
+	r, err := decompressor(b.Version, io.NewSectionReader(b.r, offset+4, size-4))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress %s: %v", f.Path(), err)
+	}
+	return r, nil
+}
+
+// readBZString reads a null terminated string prefixed by its length (including the \0).
+// It returns the string and its length
+func readBZString(in io.Reader) (string, int, error) {
+	var length [1]byte
+	if _, err := io.ReadFull(in, length[:]); err != nil {
+		return "", 0, err
+	}
+	s := make([]byte, length[0])
+	if _, err := io.ReadFull(in, s); err != nil {
+		return "", 0, err
+	}
+	return string(bytes.TrimRight(s, "\x00")), len(s), nil
+}
@@ -0,0 +1,80 @@
+package bsa
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/xnyo/papy/bsa/flags"
+)
+
+// readerAt hides the size of a bytes.Reader
+type readerAt struct {
+	r *bytes.Reader
+}
+
+func (r readerAt) ReadAt(p []byte, off int64) (int, error) { return r.r.ReadAt(p, off) }
+
+func TestReadCorruptedCounts(t *testing.T) {
+	root := testRoot(t, testFiles())
+	tests := []struct {
+		game flags.Game
+		// offset of the count in the header
+		offset int
+	}{
+		{flags.Special, 16},  // folder count
+		{flags.Special, 20},  // file count
+		{flags.Oblivion, 16}, // folder count
+		{flags.Fallout4, 12}, // file count
+	}
+	for _, tt := range tests {
+		var out memFile
+		if err := NewWriter(tt.game).Write(&out, root); err != nil {
+			t.Fatal(err)
+		}
+		binary.LittleEndian.PutUint32(out.data[tt.offset:], 0xFFFFFFF0)
+		if _, err := Read(bytes.NewReader(out.data)); err == nil {
+			t.Errorf("%s: corrupted count at %d not detected", tt.game, tt.offset)
+		}
+		if _, err := Read(readerAt{bytes.NewReader(out.data)}); err == nil {
+			t.Errorf("%s: corrupted count at %d not detected without the archive size", tt.game, tt.offset)
+		}
+	}
+}
+
+func TestReadUppercaseNames(t *testing.T) {
+	root := testRoot(t, map[string][]byte{
+		`meshes\armor\iron.nif`:  []byte("iron"),
+		`meshes\armor\steel.nif`: []byte("steel"),
+	})
+	for _, archiveFlags := range []flags.ArchiveFlags{flags.DefaultArchiveFlags, flags.DefaultArchiveFlags | flags.EmbedFileNames} {
+		w := NewWriter(flags.Special)
+		w.ArchiveFlags = archiveFlags
+		var out memFile
+		if err := w.Write(&out, root); err != nil {
+			t.Fatal(err)
+		}
+		// Archives packed by other tools may keep the case of the names, the hashes are the same
+		for _, name := range []string{`meshes\armor`, `iron.nif`, `steel.nif`} {
+			out.data = bytes.ReplaceAll(out.data, []byte(name), bytes.ToUpper([]byte(name)))
+		}
+		b, err := Read(bytes.NewReader(out.data))
+		if err != nil {
+			t.Fatalf("flags %s: %v", archiveFlags, err)
+		}
+		for _, err := range b.Verify() {
+			t.Errorf("flags %s: %v", archiveFlags, err)
+		}
+		for _, name := range []string{"iron.nif", "Steel.NIF"} {
+			f := b.Root.Folder(`Meshes\Armor`).File(name)
+			if f == nil {
+				t.Errorf("flags %s: %s not found", archiveFlags, name)
+				continue
+			}
+			if p := `meshes\armor\` + strings.ToLower(name); f.Path() != p {
+				t.Errorf("flags %s: path is %s, expected %s", archiveFlags, f.Path(), p)
+			}
+		}
+	}
+}
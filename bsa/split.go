@@ -0,0 +1,212 @@
+package bsa
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/xnyo/papy/bsa/flags"
+)
+
+// MaxLoadableSize is the maximum size of an archive the engine is able to load
+const MaxLoadableSize = 1 << 31
+
+// splitGroups are the content types that must be packed in separate archives,
+// with the suffix of their archive names. Everything else goes in the main archive.
+var splitGroups = []struct {
+	fileFlags flags.FileFlags
+	suffix    string
+}{
+	{flags.Textures, " - Textures"},
+}
+
+// splitGroup returns the suffix of the archive group f belongs to
+func splitGroup(f *File) string {
+	fileFlags := flags.PathToFileFlags(f.Path())
+	for _, group := range splitGroups {
+		if group.fileFlags == fileFlags {
+			return group.suffix
+		}
+	}
+	return ""
+}
+
+// Split represents one of the archives a Root has been split into
+type Split struct {
+	// Suffix is appended to the archive name, before the extension (eg: " - Textures")
+	Suffix string
+
+	// Root contains the files that go in this archive
+	Root *Root
+}
+
+// Name returns the name of the split archive from the name of the original archive
+// (eg: MyMod.bsa -> MyMod - Textures.bsa)
+func (s Split) Name(archiveName string) string {
+	ext := filepath.Ext(archiveName)
+	return archiveName[:len(archiveName)-len(ext)] + s.Suffix + ext
+}
+
+// IsSplitName returns true if path is the name of one of the archives that
+// archiveName can be split into (eg: MyMod0.bsa or MyMod - Textures.bsa for MyMod.bsa).
+// Names are compared ignoring case.
+func IsSplitName(archiveName string, path string) bool {
+	ext := filepath.Ext(archiveName)
+	stem := archiveName[:len(archiveName)-len(ext)]
+	if len(path) < len(archiveName) || !strings.EqualFold(path[:len(stem)], stem) || !strings.EqualFold(filepath.Ext(path), ext) {
+		return false
+	}
+	suffix := path[len(stem) : len(path)-len(ext)]
+	if isNumber(suffix) {
+		return true
+	}
+	for _, group := range splitGroups {
+		if len(suffix) >= len(group.suffix) && strings.EqualFold(suffix[:len(group.suffix)], group.suffix) && isNumber(suffix[len(group.suffix):]) {
+			return true
+		}
+	}
+	return false
+}
+
+// isNumber returns true if s is empty or contains only digits, like the suffixes of additional archives
+func isNumber(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// splitter keeps track of the archives a Root is being split into
+type splitter struct {
+	w       *Writer
+	maxSize int64
+	group   string
+
+	// splits are the archives created so far for this group
+	splits []Split
+
+	// size is the size of the last archive, in bytes
+	size int64
+
+	// folders are the folders already present in the last archive
+	folders map[string]struct{}
+}
+
+// next creates a new archive for the group
+func (s *splitter) next() {
+	suffix := s.group
+	if len(s.splits) > 0 {
+		suffix += strconv.Itoa(len(s.splits) - 1)
+	}
+	s.splits = append(s.splits, Split{
+		Suffix: suffix,
+		Root:   NewRoot(),
+	})
+	s.size = s.w.archiveHeaderSize()
+	s.folders = make(map[string]struct{})
+}
+
+// add adds a file to the last archive, or to a new one if the last archive is full
+func (s *splitter) add(f *File) error {
+	fileSize := s.w.packedSize(f)
+	folderSize := s.w.folderOverhead(f.Folder)
+	if s.w.archiveHeaderSize()+fileSize+folderSize > s.maxSize {
+		return fmt.Errorf("file %s is too big to fit in an archive", f.Path())
+	}
+	if len(s.splits) == 0 {
+		s.next()
+	}
+	_, ok := s.folders[f.Folder.Name]
+	if !ok && s.size+fileSize+folderSize > s.maxSize || ok && s.size+fileSize > s.maxSize {
+		s.next()
+		ok = false
+	}
+	if !ok {
+		s.folders[f.Folder.Name] = struct{}{}
+		s.size += folderSize
+	}
+	s.size += fileSize
+	newFile := *f
+	return s.splits[len(s.splits)-1].Root.AddFile(f.Path(), &newFile)
+}
+
+// archiveHeaderSize returns the size of the archive header
+func (w *Writer) archiveHeaderSize() int64 {
+	if w.Game == flags.Fallout4 {
+		return ba2HeaderSize
+	}
+	return headerSize
+}
+
+// folderOverhead returns the space taken by a folder in the archive, excluding its files
+func (w *Writer) folderOverhead(folder *Folder) int64 {
+	if w.Game == flags.Fallout4 {
+		// BA2 archives have no folder records
+		return 0
+	}
+	size := folderRecordSize(w.Game)
+	if w.ArchiveFlags&flags.IncludeDirectoryNames != 0 {
+		size += int64(len(folder.Name) + 2)
+	}
+	return size
+}
+
+// packedSize returns the space taken by a file in the archive (record, name and data)
+func (w *Writer) packedSize(f *File) int64 {
+	if w.Game == flags.Fallout4 {
+		// Record, data and name table entry
+		return ba2RecordSize + int64(f.Size) + 2 + int64(len(f.Path()))
+	}
+	size := fileRecordSize + w.storedSize(f)
+	if w.ArchiveFlags&flags.IncludeFileNames != 0 {
+		size += int64(len(f.Name) + 1)
+	}
+	return size
+}
+
+// Split splits the files in root into multiple archives, each one smaller than maxSize bytes.
+// If all files fit in a single archive, root is returned as is. Otherwise, content types
+// that the game expects in separate archives (textures) are split in their own archives,
+// and additional archives have an incremental number in their suffix
+// (eg: MyMod.bsa, MyMod0.bsa, MyMod - Textures.bsa, MyMod - Textures0.bsa)
+func (w *Writer) Split(root *Root, maxSize int64) ([]Split, error) {
+	size := w.archiveHeaderSize()
+	for _, folder := range root.Folders() {
+		size += w.folderOverhead(folder)
+		for _, f := range folder.files {
+			size += w.packedSize(f)
+		}
+	}
+	if size <= maxSize {
+		return []Split{{Root: root}}, nil
+	}
+
+	splitters := map[string]*splitter{
+		"": {w: w, maxSize: maxSize},
+	}
+	for _, group := range splitGroups {
+		splitters[group.suffix] = &splitter{w: w, maxSize: maxSize, group: group.suffix}
+	}
+	for _, folder := range root.Folders() {
+		for _, f := range folder.SortedFiles() {
+			group := splitGroup(f)
+			if w.Textures {
+				// Texture archives contain textures only, they are never split by content type
+				group = ""
+			}
+			if err := splitters[group].add(f); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Main archive first, then the other groups
+	result := splitters[""].splits
+	for _, group := range splitGroups {
+		result = append(result, splitters[group.suffix].splits...)
+	}
+	return result, nil
+}
@@ -0,0 +1,192 @@
+package bsa
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/xnyo/papy/bsa/flags"
+)
+
+// splitTestFiles returns 1 KiB meshes and textures in a few folders, by path.
+// They are random, so they are stored raw even in compressed archives
+// and the size of the archives is known in advance.
+func splitTestFiles() map[string][]byte {
+	files := make(map[string][]byte)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 12; i++ {
+		data := make([]byte, 1024)
+		r.Read(data)
+		files[fmt.Sprintf(`meshes\folder%d\mesh%d.nif`, i%3, i)] = data
+		if i < 6 {
+			files[fmt.Sprintf(`textures\folder%d\texture%d.dds`, i%2, i)] = data
+		}
+	}
+	return files
+}
+
+// writtenSize returns the size of the archive containing root
+func writtenSize(t *testing.T, w *Writer, root *Root) int64 {
+	var out memFile
+	if err := w.Write(&out, root); err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(out.data))
+}
+
+func TestSplit(t *testing.T) {
+	files := splitTestFiles()
+	root := testRoot(t, files)
+	for _, game := range []flags.Game{flags.Oblivion, flags.Special, flags.Fallout4} {
+		for _, archiveFlags := range []flags.ArchiveFlags{flags.DefaultArchiveFlags, flags.DefaultArchiveFlags | flags.Compressed} {
+			w := NewWriter(game)
+			w.ArchiveFlags = archiveFlags
+			name := fmt.Sprintf("%s, flags %s", game, archiveFlags)
+
+			// An archive that fits is not split, even if it's exactly as big as the limit
+			size := writtenSize(t, w, root)
+			for _, maxSize := range []int64{MaxLoadableSize, size} {
+				splits, err := w.Split(root, maxSize)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if len(splits) != 1 || splits[0].Suffix != "" || splits[0].Root != root {
+					t.Errorf("%s: split in %d archives with a limit of %d bytes, expected 1", name, len(splits), maxSize)
+				}
+			}
+
+			maxSize := size / 3
+			splits, err := w.Split(root, maxSize)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			var mainSuffixes, textureSuffixes []string
+			packed := make(map[string]int)
+			for _, split := range splits {
+				if size := writtenSize(t, w, split.Root); size > maxSize {
+					t.Errorf("%s: %s is %d bytes, more than %d", name, split.Name("MyMod.bsa"), size, maxSize)
+				}
+				isTextures := strings.HasPrefix(split.Suffix, " - Textures")
+				if isTextures {
+					textureSuffixes = append(textureSuffixes, split.Suffix)
+				} else {
+					mainSuffixes = append(mainSuffixes, split.Suffix)
+				}
+				for _, folder := range split.Root.Folders() {
+					for _, f := range folder.SortedFiles() {
+						packed[f.Path()]++
+						if isTexture := strings.HasPrefix(f.Path(), `textures\`); isTexture != isTextures {
+							t.Errorf("%s: %s packed in %s", name, f.Path(), split.Name("MyMod.bsa"))
+						}
+					}
+				}
+			}
+			for p := range files {
+				if packed[p] != 1 {
+					t.Errorf("%s: %s packed %d times", name, p, packed[p])
+				}
+			}
+			if len(packed) != len(files) {
+				t.Errorf("%s: %d files packed, expected %d", name, len(packed), len(files))
+			}
+
+			// The main archive comes first, then the textures, each with numbered suffixes
+			if len(mainSuffixes) < 2 || len(textureSuffixes) < 1 {
+				t.Errorf("%s: split in %v and %v, expected more archives", name, mainSuffixes, textureSuffixes)
+			}
+			for i, suffix := range append(mainSuffixes, textureSuffixes...) {
+				expected := ""
+				n := i
+				if i >= len(mainSuffixes) {
+					expected = " - Textures"
+					n -= len(mainSuffixes)
+				}
+				if n > 0 {
+					expected += strconv.Itoa(n - 1)
+				}
+				if suffix != expected {
+					t.Errorf("%s: archive %d has suffix %q, expected %q", name, i, suffix, expected)
+				}
+			}
+		}
+	}
+}
+
+func TestSplitTextureArchive(t *testing.T) {
+	root := testRoot(t, map[string][]byte{
+		`textures\a.dds`: testTexture(64, 64, 1, dxgiBC1Unorm, false),
+		`textures\b.dds`: testTexture(64, 64, 1, dxgiBC1Unorm, false),
+		`textures\c.dds`: testTexture(64, 64, 1, dxgiBC1Unorm, false),
+	})
+	w := NewWriter(flags.Fallout4)
+	w.Textures = true
+	splits, err := w.Split(root, writtenSize(t, w, root)-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Texture archives contain only textures, they are not split by content type
+	var suffixes []string
+	for _, split := range splits {
+		suffixes = append(suffixes, split.Suffix)
+	}
+	if strings.Join(suffixes, ",") != ",0" {
+		t.Errorf("texture archive split in %q, expected main archives only", suffixes)
+	}
+}
+
+func TestSplitFileTooBig(t *testing.T) {
+	root := testRoot(t, splitTestFiles())
+	w := NewWriter(flags.Special)
+	if _, err := w.Split(root, 1024); err == nil {
+		t.Error("a file bigger than the archive size limit has been split")
+	}
+}
+
+func TestSplitName(t *testing.T) {
+	tests := []struct {
+		archive  string
+		suffix   string
+		expected string
+	}{
+		{"MyMod.bsa", "", "MyMod.bsa"},
+		{"MyMod.bsa", "0", "MyMod0.bsa"},
+		{"MyMod.bsa", "12", "MyMod12.bsa"},
+		{"MyMod.bsa", " - Textures", "MyMod - Textures.bsa"},
+		{"MyMod.bsa", " - Textures1", "MyMod - Textures1.bsa"},
+		{"MyMod - Main.ba2", " - Textures", "MyMod - Main - Textures.ba2"},
+		{`C:\Mods\My.Mod.bsa`, "0", `C:\Mods\My.Mod0.bsa`},
+	}
+	for _, tt := range tests {
+		if got := (Split{Suffix: tt.suffix}).Name(tt.archive); got != tt.expected {
+			t.Errorf("name of %s with suffix %q is %s, expected %s", tt.archive, tt.suffix, got, tt.expected)
+		}
+	}
+}
+
+func TestIsSplitName(t *testing.T) {
+	tests := []struct {
+		path    string
+		isSplit bool
+	}{
+		{`C:\Mods\MyMod.bsa`, true},
+		{`C:\Mods\MyMod0.bsa`, true},
+		{`C:\Mods\MyMod12.bsa`, true},
+		{`C:\Mods\MyMod - Textures.bsa`, true},
+		{`C:\Mods\MyMod - Textures3.bsa`, true},
+		{`C:\Mods\mymod - textures0.BSA`, true},
+		{`C:\Mods\MyMod.ba2`, false},
+		{`C:\Mods\MyModA.bsa`, false},
+		{`C:\Mods\MyMod - Meshes.bsa`, false},
+		{`C:\Mods\MyMod - Textures.bsa.bak`, false},
+		{`C:\Mods\Other\MyMod.bsa`, false},
+		{`C:\Mods\My.bsa`, false},
+		{`C:\Mods\MyMod`, false},
+	}
+	for _, tt := range tests {
+		if got := IsSplitName(`C:\Mods\MyMod.bsa`, tt.path); got != tt.isSplit {
+			t.Errorf("IsSplitName(%s) = %v, expected %v", tt.path, got, tt.isSplit)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package bsa
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xnyo/papy/bsa/flags"
+)
+
+const (
+	// maxFolderNameLength is the maximum length of a folder name.
+	// It's stored prefixed by its length in a single byte, including the trailing \0.
+	maxFolderNameLength = 0xFF - 1
+
+	// maxPathLength is the maximum length of a file path the engine is able to look up.
+	// Paths are stored in MAX_PATH (260) buffers, including the trailing \0.
+	maxPathLength = 259
+
+	// illegalPathChars are the characters Windows does not allow in file names
+	illegalPathChars = `<>:"|?*`
+)
+
+// validatePath checks the length and the characters of a sanitized path inside an archive
+func validatePath(p string) error {
+	if len(p) > maxPathLength {
+		return fmt.Errorf("path is too long (%d characters, maximum %d)", len(p), maxPathLength)
+	}
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c >= 0x80 {
+			return fmt.Errorf("path contains non-ASCII characters, the game hashes them differently")
+		}
+		if c < 0x20 || strings.IndexByte(illegalPathChars, c) >= 0 {
+			return fmt.Errorf("path contains the illegal character %q", c)
+		}
+	}
+	for _, part := range strings.Split(p, "\\") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("path contains an empty, . or .. component, it cannot be reached")
+		}
+		if strings.HasSuffix(part, ".") || strings.HasSuffix(part, " ") {
+			return fmt.Errorf("%q ends with a dot or a space, it cannot be reached", part)
+		}
+	}
+	return nil
+}
+
+// Validate checks that all files in root can be packed and then found by the game.
+// It reports paths that are too long, contain illegal characters or cannot be reached,
+// and folders or files whose hashes collide, so only one of them could be loaded.
+// It returns all the problems found, or nil if all paths are valid.
+func (w *Writer) Validate(root *Root) []error {
+	var errs []error
+	folders := root.Folders()
+	for i, folder := range folders {
+		if len(folder.Name) > maxFolderNameLength {
+			errs = append(errs, fmt.Errorf("folder %s: name is too long (%d characters, maximum %d)", folder.Name, len(folder.Name), maxFolderNameLength))
+		}
+
+		// Folders and files are sorted by hash, colliding ones are next to each other
+		if w.Game != flags.Fallout4 && i > 0 && folders[i-1].TesHash() == folder.TesHash() {
+			errs = append(errs, fmt.Errorf("folder %s: hash collides with %s", folder.Name, folders[i-1].Name))
+		}
+		files := folder.SortedFiles()
+		for j, f := range files {
+			if err := validatePath(f.Path()); err != nil {
+				errs = append(errs, fmt.Errorf("file %s: %v", f.Path(), err))
+			}
+			if w.Game != flags.Fallout4 && j > 0 && files[j-1].TesHash() == f.TesHash() {
+				errs = append(errs, fmt.Errorf("file %s: hash collides with %s", f.Path(), files[j-1].Path()))
+			}
+		}
+	}
+	if w.Game == flags.Fallout4 {
+		errs = append(errs, ba2HashCollisions(folders)...)
+	}
+	return errs
+}
@@ -0,0 +1,77 @@
+package bsa
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/xnyo/papy/bsa/flags"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		game  flags.Game
+		paths []string
+		// err is part of the expected error, or "" if the paths are valid
+		err string
+	}{
+		{"valid", flags.Special, []string{`meshes\armor\iron.nif`, `textures\Armor\Iron.dds`, `a b\c-d_e (1).nif`}, ""},
+		{"valid", flags.Fallout4, []string{`meshes\armor\iron.nif`, `textures\Armor\Iron.dds`, `a b\c-d_e (1).nif`}, ""},
+
+		{"non-ASCII file", flags.Special, []string{`meshes\café.nif`}, "non-ASCII"},
+		{"non-ASCII folder", flags.Special, []string{`textures\Über\a.dds`}, "non-ASCII"},
+		{"non-ASCII", flags.Fallout4, []string{`meshes\café.nif`}, "non-ASCII"},
+
+		{"illegal <", flags.Special, []string{`meshes\a<b.nif`}, "illegal character"},
+		{"illegal >", flags.Special, []string{`meshes\a>b.nif`}, "illegal character"},
+		{"illegal :", flags.Special, []string{`meshes\c:\a.nif`}, "illegal character"},
+		{"illegal \"", flags.Special, []string{`meshes\a"b.nif`}, "illegal character"},
+		{"illegal |", flags.Special, []string{`meshes\a|b.nif`}, "illegal character"},
+		{"illegal ?", flags.Special, []string{`meshes\a?b.nif`}, "illegal character"},
+		{"illegal *", flags.Fallout4, []string{`meshes\*.nif`}, "illegal character"},
+		{"control character", flags.Special, []string{"meshes\\a\tb.nif"}, "illegal character"},
+
+		{"longest path", flags.Special, []string{`meshes\` + strings.Repeat("a", maxPathLength-len(`meshes\.nif`)) + ".nif"}, ""},
+		{"path too long", flags.Special, []string{`meshes\` + strings.Repeat("a", maxPathLength-len(`meshes\.nif`)+1) + ".nif"}, "path is too long"},
+		{"path too long", flags.Fallout4, []string{`meshes\` + strings.Repeat("a", 300) + ".nif"}, "path is too long"},
+		{"longest folder name", flags.Special, []string{`meshes\` + strings.Repeat("a", maxFolderNameLength-len(`meshes\`)) + `\a.n`}, ""},
+		{"folder name too long", flags.Special, []string{`meshes\` + strings.Repeat("a", maxFolderNameLength-len(`meshes\`)+1) + `\a.n`}, "name is too long"},
+
+		{". component", flags.Special, []string{`meshes\.\a.nif`}, "cannot be reached"},
+		{".. component", flags.Special, []string{`meshes\..\a.nif`}, "cannot be reached"},
+		{".. component", flags.Fallout4, []string{`meshes\..\..\a.nif`}, "cannot be reached"},
+		{"trailing dot", flags.Special, []string{`meshes\a.\a.nif`}, "cannot be reached"},
+		{"trailing space", flags.Special, []string{`meshes\a.nif `}, "cannot be reached"},
+
+		// The middle characters of the names have the same hash
+		{"file hash collision", flags.Special, []string{`meshes\aaxjgjzab.nif`, `meshes\aziieqjab.nif`}, "hash collides"},
+		{"file hash collision", flags.Oblivion, []string{`meshes\abyz.q`, `meshes\acyz.p`}, "hash collides"},
+		{"folder hash collision", flags.Special, []string{`meshes\axjgjzab\a.nif`, `meshes\ziieqjab\a.nif`}, "hash collides"},
+		{"no collision in other folders", flags.Special, []string{`meshes\a\aaxjgjzab.nif`, `meshes\b\aziieqjab.nif`}, ""},
+		{"no collision in BA2 archives", flags.Fallout4, []string{`meshes\aaxjgjzab.nif`, `meshes\aziieqjab.nif`}, ""},
+
+		// The names have the same crc, extensions are stored truncated to 4 characters
+		{"file hash collision", flags.Fallout4, []string{`meshes\bukkupvz.nif`, `meshes\sadjzgcy.nif`}, "hash collides"},
+		{"folder hash collision", flags.Fallout4, []string{`meshes\bukkupvz\a.nif`, `meshes\sadjzgcy\a.nif`}, "hash collides"},
+		{"extension collision", flags.Fallout4, []string{`meshes\a.ddsxy`, `meshes\a.ddsxz`}, "hash collides"},
+		{"no collision in BSA archives", flags.Special, []string{`meshes\bukkupvz.nif`, `meshes\sadjzgcy.nif`, `meshes\a.ddsxy`, `meshes\a.ddsxz`}, ""},
+	}
+	for _, tt := range tests {
+		root := NewRoot()
+		for _, p := range tt.paths {
+			if err := root.AddFile(p, &File{}); err != nil {
+				t.Fatalf("%s, %s: %v", tt.name, tt.game, err)
+			}
+		}
+		errs := NewWriter(tt.game).Validate(root)
+		if tt.err == "" {
+			for _, err := range errs {
+				t.Errorf("%s, %s: %v", tt.name, tt.game, err)
+			}
+			continue
+		}
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.err) {
+			t.Errorf("%s, %s: errors are %v, expected one error containing %q", tt.name, tt.game, errs, tt.err)
+		}
+	}
+}
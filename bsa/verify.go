@@ -0,0 +1,165 @@
+package bsa
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/xnyo/papy/bsa/flags"
+)
+
+// knownArchiveFlags are all the archive flags that have a meaning
+const knownArchiveFlags = flags.XMem<<1 - 1
+
+// knownFileFlags are all the file flags that have a meaning
+const knownFileFlags = flags.Miscellaneous<<1 - 1
+
+// Verify checks the integrity of the archive.
+// It makes sure that folders and files are sorted by their hash, that hashes match
+// the names, that file data is within bounds and not overlapping, that the flags are
+// consistent with the archive version and that compressed files can be decompressed.
+// It returns all the problems found, or nil if the archive is valid.
+// BA2 archives have no sorting or folder records, only their hashes and data are checked.
+// The data of BA2 texture archives is checked chunk by chunk.
+func (b *Bsa) Verify() []error {
+	var errs []error
+	if b.isDX10() {
+		errs = append(errs, b.verifyBA2Records()...)
+		errs = append(errs, b.verifyDX10Chunks()...)
+		return errs
+	}
+	if b.isBA2() {
+		errs = append(errs, b.verifyBA2Records()...)
+		errs = append(errs, b.verifyData()...)
+		return errs
+	}
+	errs = append(errs, b.verifyFlags()...)
+	errs = append(errs, b.verifyRecords()...)
+	errs = append(errs, b.verifyData()...)
+	return errs
+}
+
+// verifyFlags checks that the header flags are consistent with the archive version
+func (b *Bsa) verifyFlags() []error {
+	var errs []error
+	if b.Offset != headerSize {
+		errs = append(errs, fmt.Errorf("header: offset is %d, expected %d", b.Offset, headerSize))
+	}
+	if b.ArchiveFlags&^knownArchiveFlags != 0 {
+		errs = append(errs, fmt.Errorf("header: unknown archive flags %#x", uint32(b.ArchiveFlags&^knownArchiveFlags)))
+	}
+	if b.FileFlags&^knownFileFlags != 0 {
+		errs = append(errs, fmt.Errorf("header: unknown file flags %#x", uint32(b.FileFlags&^knownFileFlags)))
+	}
+	if b.Version == flags.Special && b.ArchiveFlags&(flags.Xbox360|flags.XMem) != 0 {
+		errs = append(errs, fmt.Errorf("header: Xbox 360 flags are set in a %s archive", b.Version))
+	}
+	if b.Version == flags.Oblivion && b.ArchiveFlags&flags.XMem != 0 {
+		errs = append(errs, fmt.Errorf("header: XMem flag is set in a %s archive", b.Version))
+	}
+	return errs
+}
+
+// verifyRecords checks the order of the records, their hashes and offsets
+func (b *Bsa) verifyRecords() []error {
+	var errs []error
+	for i, folder := range b.folders {
+		if i > 0 && b.folders[i-1].TesHash() >= folder.TesHash() {
+			errs = append(errs, fmt.Errorf("folder %s: not sorted by hash, or duplicated hash", folder.Name))
+		}
+		if b.ArchiveFlags&flags.IncludeDirectoryNames != 0 {
+			if h := FolderHash(folder.Name); h != folder.TesHash() {
+				errs = append(errs, fmt.Errorf("folder %s: hash is %016x, expected %016x", folder.Name, folder.TesHash(), h))
+			}
+		}
+		if expected := uint64(b.blockOffsets[i]) + uint64(b.TotalFileNameLength); b.folderOffsets[i] != expected {
+			errs = append(errs, fmt.Errorf("folder %s: offset is %d, expected %d", folder.Name, b.folderOffsets[i], expected))
+		}
+		for j, f := range folder.files {
+			if j > 0 && folder.files[j-1].TesHash() >= f.TesHash() {
+				errs = append(errs, fmt.Errorf("file %s: not sorted by hash, or duplicated hash", f.Path()))
+			}
+			if b.ArchiveFlags&flags.IncludeFileNames != 0 {
+				if h := TesHash(f.Name); h != f.TesHash() {
+					errs = append(errs, fmt.Errorf("file %s: hash is %016x, expected %016x", f.Path(), f.TesHash(), h))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// verifyData checks that file data is within bounds and not overlapping,
+// that embedded names match and that compressed files have the declared size
+func (b *Bsa) verifyData() []error {
+	var errs []error
+	var files []*File
+	for _, folder := range b.folders {
+		files = append(files, folder.files...)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Offset < files[j].Offset })
+	for i, f := range files {
+		start, end := int64(f.Offset), int64(f.Offset)+int64(f.StoredSize)
+		if start < b.dataStart {
+			errs = append(errs, fmt.Errorf("file %s: data offset %d overlaps the records", f.Path(), start))
+			continue
+		}
+		if b.size >= 0 && end > b.size {
+			errs = append(errs, fmt.Errorf("file %s: data ends at %d, after the end of the archive (%d)", f.Path(), end, b.size))
+			continue
+		}
+		if i > 0 {
+			prev := files[i-1]
+			if prevEnd := int64(prev.Offset) + int64(prev.StoredSize); prevEnd > start {
+				errs = append(errs, fmt.Errorf("file %s: data overlaps %s", f.Path(), prev.Path()))
+			}
+		}
+		if b.embedFileNames() {
+			if err := b.verifyEmbeddedName(f); err != nil {
+				errs = append(errs, fmt.Errorf("file %s: %v", f.Path(), err))
+				continue
+			}
+		}
+		if f.Compressed {
+			if err := verifyDecompression(f); err != nil {
+				errs = append(errs, fmt.Errorf("file %s: %v", f.Path(), err))
+			}
+		}
+	}
+	return errs
+}
+
+// verifyEmbeddedName checks that the name embedded before the data of f is its path
+func (b *Bsa) verifyEmbeddedName(f *File) error {
+	offset, _, err := b.dataOffset(f)
+	if err != nil {
+		return err
+	}
+	start := int64(f.Offset) + 1
+	name := make([]byte, offset-start)
+	if _, err := b.r.ReadAt(name, start); err != nil {
+		return fmt.Errorf("cannot read embedded name: %v", err)
+	}
+	if SanitizePath(string(name)) != f.Path() {
+		return fmt.Errorf("embedded name is %s", name)
+	}
+	return nil
+}
+
+// verifyDecompression checks that a compressed file decompresses to its declared size
+func verifyDecompression(f *File) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return fmt.Errorf("cannot decompress: %v", err)
+	}
+	if n != int64(f.Size) {
+		return fmt.Errorf("decompressed size is %d, expected %d", n, f.Size)
+	}
+	return nil
+}
@@ -0,0 +1,618 @@
+package bsa
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/xnyo/papy/bsa/flags"
+)
+
+// Writer writes BSA archives, or BA2 general archives for Fallout 4.
+// Archives are reproducible: the same files always produce a byte-identical archive.
+// Use NewWriter to instantiate a Writer struct
+type Writer struct {
+	// Game is the game the archive is built for. It determines the archive version.
+	Game flags.Game
+
+	// ArchiveFlags are the flags written in the archive header
+	ArchiveFlags flags.ArchiveFlags
+
+	// FileFlags are the content type flags written in the archive header.
+	// If they are None, they are computed from the paths of the files in the archive.
+	FileFlags flags.FileFlags
+
+	// ShouldCompress decides if a file must be compressed. If it's nil, all files are
+	// compressed if the archive is compressed. Files that the engine cannot read
+	// compressed (sounds) are never compressed.
+	ShouldCompress func(f *File) bool
+
+	// Workers is the number of goroutines that compress files concurrently.
+	// 0 for cpu cores.
+	Workers int
+
+	// MaxMemory is the maximum number of bytes of file data kept in memory while
+	// compressing files. Bigger files are compressed one at a time. 0 for 512 MiB.
+	MaxMemory int64
+
+	// Textures is true if a BA2 texture (DX10) archive must be written instead of a
+	// general one. All files must be DDS textures. It's used only for Fallout 4.
+	Textures bool
+}
+
+const (
+	// defaultMaxMemory is the default value of Writer.MaxMemory
+	defaultMaxMemory = 512 << 20
+
+	// memoryUnit is the granularity of the memory reserved for compression, in bytes
+	memoryUnit = 1 << 20
+)
+
+// neverCompressedExts are the extensions of the files that the engine
+// is not able to read if they are compressed
+var neverCompressedExts = map[string]struct{}{
+	".wav": {},
+	".xwm": {},
+	".fuz": {},
+}
+
+// NewWriter instantiates a new Writer for the specified game,
+// with the same archive flags used in official archives
+func NewWriter(game flags.Game) *Writer {
+	return &Writer{
+		Game:         game,
+		ArchiveFlags: flags.DefaultArchiveFlags,
+	}
+}
+
+// layout contains the position of every record inside an archive.
+// It's computed before writing anything, from the files metadata only.
+// The position of the file data is known only while writing it, because
+// the size of compressed files is not known in advance.
+type layout struct {
+	header  Header
+	folders []*Folder
+
+	// blockOffsets are the offsets of the file record block of each folder
+	blockOffsets []uint64
+
+	// dataStart is the offset of the data of the first file
+	dataStart int64
+}
+
+// embedFileNames returns true if the full file path must be written before the file data
+func (w *Writer) embedFileNames() bool {
+	return w.ArchiveFlags&flags.EmbedFileNames != 0
+}
+
+// checkFlags makes sure that the archive flags can be written for the game
+func (w *Writer) checkFlags() error {
+	if w.Game == flags.Oblivion && w.ArchiveFlags&flags.EmbedFileNames != 0 {
+		return fmt.Errorf("%s archives cannot embed file names", w.Game)
+	}
+	if w.Game == flags.Special && w.ArchiveFlags&flags.Xbox360 != 0 {
+		return fmt.Errorf("%s archives cannot be Xbox 360 archives", w.Game)
+	}
+	if w.ArchiveFlags&flags.XMem != 0 {
+		return fmt.Errorf("XMem compression is not supported")
+	}
+	return nil
+}
+
+// compressed returns true if f must be compressed
+func (w *Writer) compressed(f *File) bool {
+	if _, ok := neverCompressedExts[filepath.Ext(f.Name)]; ok {
+		return false
+	}
+	if w.ShouldCompress != nil {
+		return w.ShouldCompress(f)
+	}
+	return w.ArchiveFlags&flags.Compressed != 0
+}
+
+// storedSize returns the size of the uncompressed file data block of f,
+// including the embedded name. Compressed data blocks are never bigger than this,
+// because files are stored uncompressed if compression does not reduce their size.
+func (w *Writer) storedSize(f *File) int64 {
+	size := int64(f.Size)
+	if w.embedFileNames() {
+		size += 1 + int64(len(f.Path()))
+	}
+	return size
+}
+
+// layout computes the layout of the archive that will contain the files in root
+func (w *Writer) layout(root *Root) (*layout, error) {
+	l := layout{
+		header: Header{
+			Magic:        magic,
+			Version:      w.Game,
+			Offset:       headerSize,
+			ArchiveFlags: w.ArchiveFlags,
+			FileFlags:    w.FileFlags,
+		},
+		folders: root.Folders(),
+	}
+	if l.header.FileFlags == flags.None {
+		l.header.FileFlags = root.FileFlags()
+	}
+	includeDirectoryNames := w.ArchiveFlags&flags.IncludeDirectoryNames != 0
+	includeFileNames := w.ArchiveFlags&flags.IncludeFileNames != 0
+
+	// Names
+	for _, folder := range l.folders {
+		if len(folder.Name)+1 > 0xFF {
+			return nil, fmt.Errorf("folder name %s is too long", folder.Name)
+		}
+		l.header.FolderCount++
+		if includeDirectoryNames {
+			l.header.TotalFolderNameLength += uint32(len(folder.Name) + 1)
+		}
+		for _, file := range folder.SortedFiles() {
+			if file.Size > maxFileSize {
+				return nil, fmt.Errorf("file %s is too big (%d bytes)", file.Path(), file.Size)
+			}
+			if w.embedFileNames() && len(file.Path()) > 0xFF {
+				return nil, fmt.Errorf("file path %s is too long to be embedded", file.Path())
+			}
+			l.header.FileCount++
+			if includeFileNames {
+				l.header.TotalFileNameLength += uint32(len(file.Name) + 1)
+			}
+		}
+	}
+
+	// File record blocks
+	offset := int64(headerSize) + int64(l.header.FolderCount)*folderRecordSize(w.Game)
+	for _, folder := range l.folders {
+		l.blockOffsets = append(l.blockOffsets, uint64(offset))
+		if includeDirectoryNames {
+			offset += int64(len(folder.Name) + 2)
+		}
+		offset += int64(len(folder.files)) * fileRecordSize
+	}
+
+	// File names
+	l.dataStart = offset + int64(l.header.TotalFileNameLength)
+	return &l, nil
+}
+
+// recordsOffset returns the offset of the file records of the folder i,
+// after its name
+func (w *Writer) recordsOffset(l *layout, i int) int64 {
+	offset := int64(l.blockOffsets[i])
+	if w.ArchiveFlags&flags.IncludeDirectoryNames != 0 {
+		offset += int64(len(l.folders[i].Name) + 2)
+	}
+	return offset
+}
+
+// Write writes the files in root to out, as a BSA archive (or a BA2 archive for Fallout 4).
+// File data is streamed to out one file at a time: records are written first with
+// the information known in advance, and patched once all file data has been written.
+// For this reason, out must be seekable.
+func (w *Writer) Write(out io.WriteSeeker, root *Root) error {
+	if !w.Game.IsValid() {
+		return fmt.Errorf("cannot write archives for %s", w.Game)
+	}
+	if errs := w.Validate(root); len(errs) > 0 {
+		if len(errs) > 1 {
+			return fmt.Errorf("%v (and %d more invalid paths)", errs[0], len(errs)-1)
+		}
+		return errs[0]
+	}
+	if w.Game == flags.Fallout4 && w.Textures {
+		return w.writeDX10(out, root)
+	}
+	if w.Game == flags.Fallout4 {
+		return w.writeBA2(out, root)
+	}
+	if err := w.checkFlags(); err != nil {
+		return err
+	}
+	l, err := w.layout(root)
+	if err != nil {
+		return err
+	}
+	start, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(out)
+
+	// Header
+	if err := binary.Write(buf, binary.LittleEndian, l.header); err != nil {
+		return fmt.Errorf("cannot write header: %v", err)
+	}
+
+	// Folder records.
+	// The offset points to the file record block, plus the total length of file names.
+	for i, folder := range l.folders {
+		var record interface{}
+		offset := l.blockOffsets[i] + uint64(l.header.TotalFileNameLength)
+		hash := storedHash(w.ArchiveFlags, folder.TesHash())
+		if w.Game == flags.Special {
+			record = folderRecordSE{
+				Hash:   hash,
+				Count:  uint32(len(folder.files)),
+				Offset: offset,
+			}
+		} else {
+			record = folderRecord{
+				Hash:   hash,
+				Count:  uint32(len(folder.files)),
+				Offset: uint32(offset),
+			}
+		}
+		if err := binary.Write(buf, binary.LittleEndian, record); err != nil {
+			return fmt.Errorf("cannot write folder record for %s: %v", folder.Name, err)
+		}
+	}
+
+	// File record blocks.
+	// Sizes and offsets are not known yet, they will be patched later.
+	records := make([][]fileRecord, len(l.folders))
+	for i, folder := range l.folders {
+		if w.ArchiveFlags&flags.IncludeDirectoryNames != 0 {
+			if err := writeBZString(buf, folder.Name); err != nil {
+				return fmt.Errorf("cannot write folder name %s: %v", folder.Name, err)
+			}
+		}
+		records[i] = make([]fileRecord, len(folder.files))
+		for j, file := range folder.SortedFiles() {
+			records[i][j].Hash = storedHash(w.ArchiveFlags, file.TesHash())
+		}
+		if err := binary.Write(buf, binary.LittleEndian, records[i]); err != nil {
+			return fmt.Errorf("cannot write file records for %s: %v", folder.Name, err)
+		}
+	}
+
+	// File names
+	if w.ArchiveFlags&flags.IncludeFileNames != 0 {
+		for _, folder := range l.folders {
+			for _, file := range folder.SortedFiles() {
+				if _, err := io.WriteString(buf, file.Name+"\x00"); err != nil {
+					return fmt.Errorf("cannot write file name %s: %v", file.Name, err)
+				}
+			}
+		}
+	}
+
+	// File data.
+	// Files are compressed by the workers, and written here in the same order as their records.
+	// The size has the compression toggle bit set if the file compression
+	// is different from the archive one.
+	done := make(chan struct{})
+	defer close(done)
+	queue := w.compressFiles(l.folders, done)
+	offset := l.dataStart
+	for i, folder := range l.folders {
+		for j, file := range folder.SortedFiles() {
+			if offset > maxArchiveSize {
+				return fmt.Errorf("archive is too big, it must be smaller than 4 GiB")
+			}
+			packed := queue.next()
+			size, err := w.writeFileData(buf, file, packed)
+			if err != nil {
+				return err
+			}
+			records[i][j].Size = size
+			records[i][j].Offset = uint32(offset)
+			if packed.compressed != (w.ArchiveFlags&flags.Compressed != 0) {
+				records[i][j].Size |= compressionToggle
+			}
+			offset += int64(size)
+		}
+	}
+	if offset > maxArchiveSize {
+		return fmt.Errorf("archive is too big, it must be smaller than 4 GiB")
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+
+	// Patch the file records
+	for i, folder := range l.folders {
+		if _, err := out.Seek(start+w.recordsOffset(l, i), io.SeekStart); err != nil {
+			return err
+		}
+		if err := binary.Write(out, binary.LittleEndian, records[i]); err != nil {
+			return fmt.Errorf("cannot write file records for %s: %v", folder.Name, err)
+		}
+	}
+	_, err = out.Seek(start+offset, io.SeekStart)
+	return err
+}
+
+// packedData is the data of a file, ready to be written in the archive
+type packedData struct {
+	// data is the compressed data, or the uncompressed data if compression does not
+	// reduce the size. It's nil if the file is not compressed and must be streamed.
+	data []byte
+
+	// offset and size are the section of the file that is streamed if data is nil
+	offset int64
+	size   int64
+
+	// compressed is true if data is compressed
+	compressed bool
+
+	// chunks are the packed mipmap chunks of textures in BA2 texture archives
+	chunks []*packedData
+
+	err error
+}
+
+// compressionJob represents a file that has to be compressed by a worker
+type compressionJob struct {
+	file *File
+
+	// result receives the packed data of the file
+	result chan *packedData
+
+	// memory is the number of memory units reserved for the file
+	memory int
+}
+
+// compressionQueue returns the packed data of the files compressed
+// by the workers, in the same order they have been sent to them
+type compressionQueue struct {
+	jobs <-chan compressionJob
+
+	// memory contains a value for each memory unit in use
+	memory chan struct{}
+
+	// reserved is the number of memory units reserved for the last file returned by next
+	reserved int
+}
+
+// next returns the packed data of the next file. The memory of the previous
+// file is released, so its data must have been written before calling next.
+func (q *compressionQueue) next() *packedData {
+	for ; q.reserved > 0; q.reserved-- {
+		<-q.memory
+	}
+	job := <-q.jobs
+	q.reserved = job.memory
+	return <-job.result
+}
+
+// streamed returns the packed data of a section of a file that is not compressed
+func streamed(offset int64, size int64) *packedData {
+	return &packedData{offset: offset, size: size}
+}
+
+// memoryUnits returns the number of memory units needed to pack file:
+// its data and its compressed data. Files that are not compressed are streamed.
+// Bigger files than max units reserve max units, so they can be compressed alone.
+func (w *Writer) memoryUnits(file *File, max int) int {
+	if !w.compressed(file) {
+		return 0
+	}
+	units := (2*int64(file.Size) + memoryUnit - 1) / memoryUnit
+	if units > int64(max) {
+		return max
+	}
+	return int(units)
+}
+
+// pack reads and compresses a file, if it must be compressed
+func (w *Writer) pack(file *File) *packedData {
+	if w.Game == flags.Fallout4 && w.Textures {
+		return w.packTexture(file)
+	}
+	if !w.compressed(file) {
+		return streamed(0, int64(file.Size))
+	}
+	data, err := readFileData(file)
+	if err != nil {
+		return &packedData{err: err}
+	}
+	return w.compressData(file, data)
+}
+
+// compressData compresses the data of a file.
+// The data is returned as is if compression does not reduce its size.
+func (w *Writer) compressData(file *File, data []byte) *packedData {
+	compressedData, err := compress(w.Game, data)
+	if err != nil {
+		return &packedData{err: fmt.Errorf("cannot compress %s: %v", file.Path(), err)}
+	}
+	if 4+len(compressedData) >= len(data) {
+		// Compression does not reduce the size, store it uncompressed
+		return &packedData{data: data}
+	}
+	return &packedData{data: compressedData, compressed: true}
+}
+
+// compressWorker compresses the files received from the "jobs" channel.
+// It reports results in the result channel of each job.
+func (w *Writer) compressWorker(wg *sync.WaitGroup, jobs <-chan compressionJob) {
+	defer wg.Done()
+	for job := range jobs {
+		job.result <- w.pack(job.file)
+	}
+}
+
+// compressFiles spawns the compression workers and sends them all the files, in folders order.
+// It returns a queue that returns their packed data in the same order, so it can be
+// written sequentially. The size of the files being compressed or waiting to be written is
+// limited by MaxMemory, so big files are not all kept in memory at the same time.
+// Closing done stops the workers.
+func (w *Writer) compressFiles(folders []*Folder, done <-chan struct{}) *compressionQueue {
+	workers := w.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	maxMemory := w.MaxMemory
+	if maxMemory <= 0 {
+		maxMemory = defaultMaxMemory
+	}
+	maxUnits := int((maxMemory + memoryUnit - 1) / memoryUnit)
+	jobs := make(chan compressionJob)
+	pending := make(chan compressionJob, workers*2)
+	queue := compressionQueue{
+		jobs:   pending,
+		memory: make(chan struct{}, maxUnits),
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go w.compressWorker(&wg, jobs)
+	}
+	go func() {
+		defer close(pending)
+		defer close(jobs)
+		for _, folder := range folders {
+			for _, file := range folder.SortedFiles() {
+				job := compressionJob{
+					file:   file,
+					result: make(chan *packedData, 1),
+					memory: w.memoryUnits(file, maxUnits),
+				}
+				for i := 0; i < job.memory; i++ {
+					select {
+					case queue.memory <- struct{}{}:
+					case <-done:
+						return
+					}
+				}
+				select {
+				case pending <- job:
+				case <-done:
+					return
+				}
+				select {
+				case jobs <- job:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return &queue
+}
+
+// writeFileData writes the data block of a single file, from its packed data.
+// It returns the size of the data block.
+func (w *Writer) writeFileData(out io.Writer, file *File, packed *packedData) (uint32, error) {
+	if packed.err != nil {
+		return 0, packed.err
+	}
+	var size uint32
+	if w.embedFileNames() {
+		if err := writeBString(out, file.Path()); err != nil {
+			return 0, fmt.Errorf("cannot write embedded name for %s: %v", file.Path(), err)
+		}
+		size += 1 + uint32(len(file.Path()))
+	}
+	if packed.compressed {
+		// Compressed data is prefixed by the original size
+		if err := binary.Write(out, binary.LittleEndian, file.Size); err != nil {
+			return 0, fmt.Errorf("cannot write original size for %s: %v", file.Path(), err)
+		}
+		size += 4
+	}
+	n, err := writePackedData(out, file, packed)
+	return size + n, err
+}
+
+// writePackedData writes the packed data of a file, or streams it from the source
+// if it's not compressed. It returns the number of bytes written.
+func writePackedData(out io.Writer, file *File, packed *packedData) (uint32, error) {
+	if packed.data != nil {
+		if _, err := out.Write(packed.data); err != nil {
+			return 0, fmt.Errorf("cannot write data for %s: %v", file.Path(), err)
+		}
+		return uint32(len(packed.data)), nil
+	}
+
+	// Uncompressed, stream it from the source
+	in, err := openSection(file, packed.offset, packed.size)
+	if err != nil {
+		return 0, fmt.Errorf("cannot open %s: %v", file.Path(), err)
+	}
+	defer in.Close()
+	n, err := io.Copy(out, in)
+	if err != nil {
+		return 0, fmt.Errorf("cannot write data for %s: %v", file.Path(), err)
+	}
+	if n != packed.size {
+		return 0, fmt.Errorf("file %s changed size while packing (expected %d bytes, got %d)", file.Path(), packed.size, n)
+	}
+	return uint32(n), nil
+}
+
+// sectionReadCloser reads a section of a file and closes the file
+type sectionReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// openSection opens size bytes of the uncompressed data of file, starting from offset
+func openSection(file *File, offset int64, size int64) (io.ReadCloser, error) {
+	in, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	if r, ok := in.(io.ReaderAt); ok {
+		return sectionReadCloser{io.NewSectionReader(r, offset, size), in}, nil
+	}
+
+	// Compressed files in archives can only be read sequentially
+	if _, err := io.CopyN(ioutil.Discard, in, offset); err != nil {
+		in.Close()
+		return nil, err
+	}
+	return sectionReadCloser{io.LimitReader(in, size), in}, nil
+}
+
+// readFileData reads the whole uncompressed data of a file
+func readFileData(file *File) ([]byte, error) {
+	in, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %v", file.Path(), err)
+	}
+	defer in.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(in, int64(file.Size)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %v", file.Path(), err)
+	}
+	if len(data) != int(file.Size) {
+		return nil, fmt.Errorf("file %s changed size while packing (expected %d bytes, got %d)", file.Path(), file.Size, len(data))
+	}
+	return data, nil
+}
+
+// WriteFile writes the files in root to a new BSA archive at path
+func (w *Writer) WriteFile(path string, root *Root) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("cannot create archive %s: %v", path, err)
+	}
+	if err := w.Write(f, root); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeBString writes a string prefixed by its length
+func writeBString(out io.Writer, s string) error {
+	if _, err := out.Write([]byte{byte(len(s))}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(out, s)
+	return err
+}
+
+// writeBZString writes a null terminated string prefixed by its length (including the \0)
+func writeBZString(out io.Writer, s string) error {
+	return writeBString(out, s+"\x00")
+}
@@ -0,0 +1,386 @@
+package bsa
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xnyo/papy/bsa/flags"
+)
+
+// memFile is an in memory io.WriteSeeker
+type memFile struct {
+	data []byte
+	pos  int64
+}
+
+func (m *memFile) Write(p []byte) (int, error) {
+	if end := m.pos + int64(len(p)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	m.pos += int64(copy(m.data[m.pos:], p))
+	return len(p), nil
+}
+
+func (m *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		m.pos = offset
+	case io.SeekCurrent:
+		m.pos += offset
+	case io.SeekEnd:
+		m.pos = int64(len(m.data)) + offset
+	}
+	return m.pos, nil
+}
+
+// testFiles returns the contents of the files packed in tests, by path.
+// They are compressible, incompressible (random) and empty files.
+func testFiles() map[string][]byte {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	return map[string][]byte{
+		`meshes\armor\iron\cuirass.nif`:       []byte(strings.Repeat("iron cuirass ", 1000)),
+		`meshes\armor\iron\gauntlets.nif`:     []byte("gauntlets"),
+		`meshes\actors\character\idle.kf`:     random,
+		`textures\armor\iron\cuirass_n.dds`:   []byte(strings.Repeat("normal map ", 500)),
+		`sound\fx\npc\horse\foot\walk_01.wav`: []byte(strings.Repeat("RIFF", 200)),
+		`scripts\myquestscript.pex`:           []byte("pex"),
+		`interface\translations\mymod_en.txt`: {},
+		`meshes\clutter\a.nif`:                []byte("a"),
+	}
+}
+
+// testRoot writes files to loose files in a temporary folder and returns a Root containing them
+func testRoot(t *testing.T, files map[string][]byte) *Root {
+	dir := t.TempDir()
+	root := NewRoot()
+	i := 0
+	for p, data := range files {
+		i++
+		source := filepath.Join(dir, strings.Repeat("f", i))
+		if err := ioutil.WriteFile(source, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := NewLooseFile(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := root.AddFile(p, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestRoundTrip(t *testing.T) {
+	files := testFiles()
+	root := testRoot(t, files)
+	for _, game := range []flags.Game{flags.Oblivion, flags.Legendary, flags.Special, flags.Fallout4} {
+		for _, archiveFlags := range []flags.ArchiveFlags{
+			flags.DefaultArchiveFlags,
+			flags.DefaultArchiveFlags | flags.Compressed,
+			flags.DefaultArchiveFlags | flags.EmbedFileNames,
+			flags.DefaultArchiveFlags | flags.Compressed | flags.EmbedFileNames,
+		} {
+			if game == flags.Oblivion && archiveFlags&flags.EmbedFileNames != 0 {
+				// v103 archives cannot embed file names
+				continue
+			}
+			w := NewWriter(game)
+			w.ArchiveFlags = archiveFlags
+			var out memFile
+			if err := w.Write(&out, root); err != nil {
+				t.Fatalf("%s, flags %#x: cannot write: %v", game, archiveFlags, err)
+			}
+			b, err := Read(bytes.NewReader(out.data))
+			if err != nil {
+				t.Fatalf("%s, flags %#x: cannot read: %v", game, archiveFlags, err)
+			}
+			for _, err := range b.Verify() {
+				t.Errorf("%s, flags %#x: %v", game, archiveFlags, err)
+			}
+			if b.FileCount != uint32(len(files)) {
+				t.Errorf("%s, flags %#x: expected %d files, found %d", game, archiveFlags, len(files), b.FileCount)
+			}
+			for _, folder := range b.Root.Folders() {
+				for _, f := range folder.SortedFiles() {
+					expected, ok := files[f.Path()]
+					if !ok {
+						t.Errorf("%s, flags %#x: unexpected file %s", game, archiveFlags, f.Path())
+						continue
+					}
+					data, err := readFileData(f)
+					if err != nil {
+						t.Fatalf("%s, flags %#x: %v", game, archiveFlags, err)
+					}
+					if !bytes.Equal(data, expected) {
+						t.Errorf("%s, flags %#x: %s has different content", game, archiveFlags, f.Path())
+					}
+				}
+			}
+		}
+	}
+}
+
+// testTexture returns a DDS texture with a DX10 header and pixel data that depends on its size
+func testTexture(width, height, mipCount, format uint32, cubemap bool) []byte {
+	header := ddsHeader{
+		Size:        ddsHeaderSize,
+		Height:      height,
+		Width:       width,
+		MipMapCount: mipCount,
+		PixelFormat: ddsPixelFormat{Size: 32, Flags: ddsPixelFormatFourCC, FourCC: [4]byte{'D', 'X', '1', '0'}},
+	}
+	dx10 := ddsHeaderDX10{DXGIFormat: format, ResourceDimension: ddsDimensionTexture2D, ArraySize: 1}
+	if cubemap {
+		header.Caps2 = ddsCaps2Cubemap | ddsCaps2AllFaces
+		dx10.MiscFlag = ddsMiscTextureCube
+	}
+	var buf bytes.Buffer
+	buf.Write(ddsMagic[:])
+	binary.Write(&buf, binary.LittleEndian, header)
+	binary.Write(&buf, binary.LittleEndian, dx10)
+	t := ddsTexture{width: width, height: height, mipCount: mipCount, format: format, cubemap: cubemap}
+	data := make([]byte, t.dataSize())
+	for i := range data {
+		data[i] = byte(i * i >> 10)
+	}
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func TestTexturesRoundTrip(t *testing.T) {
+	files := map[string][]byte{
+		`textures\armor\iron\cuirass_d.dds`: testTexture(2048, 1024, 12, dxgiBC1Unorm, false),
+		`textures\armor\iron\cuirass_n.dds`: testTexture(512, 512, 10, dxgiBC7Unorm, false),
+		`textures\sky\cubemap.dds`:          testTexture(256, 256, 9, dxgiBC3Unorm, true),
+		`textures\interface\icon.dds`:       testTexture(64, 32, 1, dxgiB8G8R8A8Unorm, false),
+	}
+	root := testRoot(t, files)
+	for _, archiveFlags := range []flags.ArchiveFlags{flags.DefaultArchiveFlags, flags.DefaultArchiveFlags | flags.Compressed} {
+		w := NewWriter(flags.Fallout4)
+		w.Textures = true
+		w.ArchiveFlags = archiveFlags
+		var out memFile
+		if err := w.Write(&out, root); err != nil {
+			t.Fatalf("flags %#x: cannot write: %v", archiveFlags, err)
+		}
+		b, err := Read(bytes.NewReader(out.data))
+		if err != nil {
+			t.Fatalf("flags %#x: cannot read: %v", archiveFlags, err)
+		}
+		for _, err := range b.Verify() {
+			t.Errorf("flags %#x: %v", archiveFlags, err)
+		}
+
+		// The DDS headers are rebuilt, they must describe the same texture
+		for _, folder := range b.Root.Folders() {
+			for _, f := range folder.SortedFiles() {
+				data, err := readFileData(f)
+				if err != nil {
+					t.Fatalf("flags %#x: %v", archiveFlags, err)
+				}
+				if len(data) != int(f.Size) {
+					t.Errorf("flags %#x: %s is %d bytes, expected %d", archiveFlags, f.Path(), len(data), f.Size)
+				}
+				expected, err := readDDSHeader(bytes.NewReader(files[f.Path()]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := readDDSHeader(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("flags %#x: %s: %v", archiveFlags, f.Path(), err)
+				}
+				if got.width != expected.width || got.height != expected.height || got.mipCount != expected.mipCount ||
+					got.format != expected.format || got.cubemap != expected.cubemap {
+					t.Errorf("flags %#x: %s: header is %+v, expected %+v", archiveFlags, f.Path(), got, expected)
+				}
+				if !bytes.Equal(data[got.dataOffset:], files[f.Path()][expected.dataOffset:]) {
+					t.Errorf("flags %#x: %s has different pixel data", archiveFlags, f.Path())
+				}
+			}
+		}
+
+		// Packing the textures read from the archive gives the same archive
+		var repacked memFile
+		if err := w.Write(&repacked, b.Root); err != nil {
+			t.Fatalf("flags %#x: cannot write: %v", archiveFlags, err)
+		}
+		if !bytes.Equal(out.data, repacked.data) {
+			t.Errorf("flags %#x: repacked archive is different", archiveFlags)
+		}
+	}
+}
+
+func TestWriteInvalidTextures(t *testing.T) {
+	// Offsets of the fields of the headers that are changed, including the magic
+	const (
+		depthOffset             = 4 + 20
+		fourCCOffset            = 4 + 80
+		caps2Offset             = 4 + 108
+		resourceDimensionOffset = 4 + ddsHeaderSize + 4
+		arraySizeOffset         = 4 + ddsHeaderSize + 12
+	)
+	set := func(data []byte, offset int, value uint32) []byte {
+		data = append([]byte(nil), data...)
+		binary.LittleEndian.PutUint32(data[offset:], value)
+		return data
+	}
+	// legacy replaces the DX10 header of a BC1 texture with the DXT1 FourCC
+	legacy := func(data []byte) []byte {
+		data = set(data, fourCCOffset, binary.LittleEndian.Uint32([]byte("DXT1")))
+		return append(data[:4+ddsHeaderSize:4+ddsHeaderSize], data[4+ddsHeaderSize+20:]...)
+	}
+	texture := testTexture(64, 64, 7, dxgiBC1Unorm, false)
+	cubemap := testTexture(64, 64, 7, dxgiBC1Unorm, true)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"texture array", set(append(append([]byte(nil), texture...), texture[4+ddsHeaderSize+20:]...), arraySizeOffset, 2)},
+		{"volume texture", set(append(append([]byte(nil), texture...), texture[4+ddsHeaderSize+20:]...), depthOffset, 2)},
+		{"3D resource", set(texture, resourceDimensionOffset, 4)},
+		{"partial cubemap", set(legacy(cubemap), caps2Offset, ddsCaps2Cubemap|0x400)},
+		{"extra data", append(append([]byte(nil), texture...), 0, 0, 0, 0)},
+		{"truncated", texture[:len(texture)-1]},
+	}
+	for _, tt := range tests {
+		root := testRoot(t, map[string][]byte{`textures\test\texture.dds`: tt.data})
+		w := NewWriter(flags.Fallout4)
+		w.Textures = true
+		if err := w.Write(&memFile{}, root); err == nil {
+			t.Errorf("%s: packed without errors", tt.name)
+		}
+	}
+
+	// The same textures with valid headers can be packed
+	for _, data := range [][]byte{texture, legacy(cubemap)} {
+		root := testRoot(t, map[string][]byte{`textures\test\texture.dds`: data})
+		w := NewWriter(flags.Fallout4)
+		w.Textures = true
+		if err := w.Write(&memFile{}, root); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestWriteSameOutputWithAnyWorkersAndMemory(t *testing.T) {
+	root := testRoot(t, testFiles())
+	for _, game := range []flags.Game{flags.Special, flags.Fallout4} {
+		var outputs [][]byte
+		for _, config := range []struct {
+			workers   int
+			maxMemory int64
+		}{{1, 0}, {2, 0}, {8, 0}, {8, 1}} {
+			w := NewWriter(game)
+			w.ArchiveFlags |= flags.Compressed
+			w.Workers = config.workers
+			w.MaxMemory = config.maxMemory
+			var out memFile
+			if err := w.Write(&out, root); err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, out.data)
+		}
+		for i := 1; i < len(outputs); i++ {
+			if !bytes.Equal(outputs[0], outputs[i]) {
+				t.Errorf("%s: output depends on the number of workers or on the memory limit", game)
+			}
+		}
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	root := testRoot(t, testFiles())
+	path := filepath.Join(t.TempDir(), "test.bsa")
+	if err := NewWriter(flags.Special).WriteFile(path, root); err != nil {
+		t.Fatal(err)
+	}
+	b, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for _, err := range b.Verify() {
+		t.Error(err)
+	}
+}
+
+func TestCompressionPolicy(t *testing.T) {
+	compressible := []byte(strings.Repeat("compressible ", 1000))
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	root := testRoot(t, map[string][]byte{
+		`sound\fx\a.wav`:          compressible,
+		`SOUND\VOICE\B.XWM`:       compressible,
+		`sound\voice\c.fuz`:       compressible,
+		`meshes\compressible.nif`: compressible,
+		`meshes\random.nif`:       random,
+		`meshes\tiny.nif`:         []byte("a"),
+		`meshes\empty.nif`:        {},
+		`textures\forced.dds`:     compressible,
+	})
+	tests := []struct {
+		name           string
+		archiveFlags   flags.ArchiveFlags
+		shouldCompress func(f *File) bool
+		compressed     map[string]bool
+	}{
+		{
+			"uncompressed archive",
+			flags.DefaultArchiveFlags,
+			nil,
+			map[string]bool{},
+		},
+		{
+			// Sounds are never compressed, files are stored raw if compressing does not make them smaller
+			"compressed archive",
+			flags.DefaultArchiveFlags | flags.Compressed,
+			nil,
+			map[string]bool{`meshes\compressible.nif`: true, `textures\forced.dds`: true},
+		},
+		{
+			"compress all",
+			flags.DefaultArchiveFlags,
+			func(f *File) bool { return true },
+			map[string]bool{`meshes\compressible.nif`: true, `textures\forced.dds`: true},
+		},
+		{
+			"compress textures only",
+			flags.DefaultArchiveFlags | flags.Compressed,
+			func(f *File) bool { return strings.HasSuffix(f.Name, ".dds") },
+			map[string]bool{`textures\forced.dds`: true},
+		},
+	}
+	for _, game := range []flags.Game{flags.Oblivion, flags.Special, flags.Fallout4} {
+		for _, tt := range tests {
+			w := NewWriter(game)
+			w.ArchiveFlags = tt.archiveFlags
+			w.ShouldCompress = tt.shouldCompress
+			var out memFile
+			if err := w.Write(&out, root); err != nil {
+				t.Fatalf("%s, %s: %v", game, tt.name, err)
+			}
+			b, err := Read(bytes.NewReader(out.data))
+			if err != nil {
+				t.Fatalf("%s, %s: %v", game, tt.name, err)
+			}
+			for _, err := range b.Verify() {
+				t.Errorf("%s, %s: %v", game, tt.name, err)
+			}
+			for _, folder := range b.Root.Folders() {
+				for _, f := range folder.SortedFiles() {
+					if f.Compressed != tt.compressed[f.Path()] {
+						t.Errorf("%s, %s: %s compressed is %v, expected %v", game, tt.name, f.Path(), f.Compressed, tt.compressed[f.Path()])
+					}
+				}
+			}
+		}
+	}
+}
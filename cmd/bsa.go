@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/xnyo/papy/bsa"
+)
+
+// JSON output, --json flag
+var jsonOutput bool
+
+func init() {
+	lsCmd.Flags().BoolVar(&jsonOutput, "json", false, "json output")
+	bsaCmd.AddCommand(lsCmd)
+	bsaCmd.AddCommand(verifyCmd)
+	bsaCmd.AddCommand(diffCmd)
+	rootCmd.AddCommand(bsaCmd)
+}
+
+var bsaCmd = &cobra.Command{
+	Use:   "bsa",
+	Short: "Tools to inspect BSA and BA2 archives",
+}
+
+// listEntry represents a file in the output of bsa ls
+type listEntry struct {
+	Path       string `json:"path"`
+	FolderHash string `json:"folder_hash"`
+	FileHash   string `json:"file_hash"`
+	StoredSize uint32 `json:"stored_size"`
+	Size       uint32 `json:"size"`
+	Offset     uint64 `json:"offset"`
+	Compressed bool   `json:"compressed"`
+}
+
+// newListEntry creates a listEntry from a file read from the archive b
+func newListEntry(b *bsa.Bsa, f *bsa.File) listEntry {
+	folderHash, fileHash := b.Hashes(f)
+	return listEntry{
+		Path:       f.Path(),
+		FolderHash: fmt.Sprintf("%016x", folderHash),
+		FileHash:   fmt.Sprintf("%016x", fileHash),
+		StoredSize: f.StoredSize,
+		Size:       f.Size,
+		Offset:     f.Offset,
+		Compressed: f.Compressed,
+	}
+}
+
+var lsCmd = &cobra.Command{
+	Use:   "ls archive",
+	Short: "Lists all files in a BSA archive, with their hashes, sizes, offsets and compression",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := bsa.Open(args[0])
+		if err != nil {
+			Fatal(err)
+		}
+		defer b.Close()
+
+		entries := []listEntry{}
+		for _, folder := range b.Root.Folders() {
+			for _, f := range folder.SortedFiles() {
+				entries = append(entries, newListEntry(b, f))
+			}
+		}
+
+		if jsonOutput {
+			e := json.NewEncoder(os.Stdout)
+			e.SetIndent("", "  ")
+			if err := e.Encode(entries); err != nil {
+				Fatal(err)
+			}
+			return
+		}
+
+		VerbosePrintf(
+			"%s, version %#x, archive flags %#x, file flags %#x, %d folders, %d files\n",
+			b.Version, uint32(b.Version), uint32(b.ArchiveFlags), uint32(b.FileFlags), b.FolderCount, b.FileCount,
+		)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PATH\tFOLDER HASH\tFILE HASH\tSTORED SIZE\tSIZE\tOFFSET\tCOMPRESSED")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%t\n", e.Path, e.FolderHash, e.FileHash, e.StoredSize, e.Size, e.Offset, e.Compressed)
+		}
+		w.Flush()
+	},
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify archive...",
+	Short: "Checks the integrity of BSA archives. Exits with status code 1 if any archive is corrupted",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		corrupted := false
+		for _, path := range args {
+			b, err := bsa.Open(path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				corrupted = true
+				continue
+			}
+			errs := b.Verify()
+			b.Close()
+			for _, err := range errs {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			}
+			if len(errs) > 0 {
+				corrupted = true
+				continue
+			}
+			VerbosePrintf("%s: ok\n", path)
+		}
+		if corrupted {
+			os.Exit(1)
+		}
+	},
+}
+
+// openRoot opens the archive or the loose files folder at path.
+// The returned archive is nil if path is a folder.
+func openRoot(path string) (*bsa.Root, *bsa.Bsa, error) {
+	s, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.IsDir() {
+		root, skipped, err := bsa.NewLooseRoot(path)
+		for _, path := range skipped {
+			VerbosePrintf("Skipping %s, files at the top level of a folder cannot be in an archive\n", path)
+		}
+		return root, nil, err
+	}
+	b, err := bsa.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b.Root, b, nil
+}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff a b",
+	Short: "Prints the differences between two BSA archives, or an archive and a loose files folder",
+	Long: `Prints the differences between two BSA archives, or an archive and a loose files folder.
+Files are compared by their content. Each line starts with:
+  + added file
+  - removed file
+  ~ changed file
+  c same file, compressed in one archive and uncompressed in the other one`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		aRoot, a, err := openRoot(args[0])
+		if err != nil {
+			Fatal(err)
+		}
+		if a != nil {
+			defer a.Close()
+		}
+		bRoot, b, err := openRoot(args[1])
+		if err != nil {
+			Fatal(err)
+		}
+		if b != nil {
+			defer b.Close()
+		}
+
+		// Headers can be compared only between archives
+		if a != nil && b != nil {
+			for _, d := range bsa.DiffHeaders(a, b) {
+				fmt.Printf("header %s\n", d)
+			}
+		}
+		diffs, err := bsa.DiffFiles(aRoot, bRoot)
+		if err != nil {
+			Fatal(err)
+		}
+		for _, d := range diffs {
+			fmt.Println(d)
+		}
+	},
+}
@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// Compile all scripts, --all flag
+var compileAll bool
+
+func init() {
+	buildCmd.Flags().IntVarP(&workers, "workers", "w", 0, "number of workers. 0 for cpu cores.")
+	buildCmd.Flags().BoolVarP(&compileAll, "all", "a", false, "compile all scripts, even the ones that have not been edited")
+	rootCmd.AddCommand(buildCmd)
+}
+
+var buildCmd = &cobra.Command{
+	Use:   "build [project_file]",
+	Short: "Compiles the scripts that have been edited, or all scripts with --all",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		compile(projectFileArg(args), compileAll)
+	},
+}
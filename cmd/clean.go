@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/xnyo/papy/papyrus"
+)
+
+func init() {
+	rootCmd.AddCommand(cleanCmd)
+}
+
+var cleanCmd = &cobra.Command{
+	Use:   "clean [project_file]",
+	Short: "Deletes the compiled scripts of the project and the build cache",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		p, err := papyrus.UnmarshalFile(projectFileArg(args), &Config)
+		if err != nil {
+			Fatal(err)
+		}
+		deleted, err := p.Clean()
+		for _, path := range deleted {
+			VerbosePrintf("Deleted %s\n", path)
+		}
+		if err != nil {
+			Fatal(err)
+		}
+		fmt.Printf("Deleted %d compiled scripts.\n", len(deleted))
+	},
+}
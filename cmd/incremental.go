@@ -23,84 +23,107 @@ var incrementalCmd = &cobra.Command{
 	Short: "Compiles all new scripts or that have been edited",
 	Args:  cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		// Read yaml
-		projectFile := "papy.yaml"
-		if len(args) >= 1 {
-			projectFile = args[0]
-		}
-		p, err := papyrus.UnmarshalFile(projectFile, &Config)
-		if err != nil {
-			Fatal(err)
-		}
-
-		// Check folders
-		if err = p.CheckFolders(); err != nil {
-			Fatal(err)
-		}
-
-		// Check compiler
-		if s, err := os.Stat(Config.CompilerPath); err != nil || s.IsDir() {
-			FatalF("compiler check error: %v", err)
-		}
-		VerbosePrintf("Using compiler %s\n", Config.CompilerPath)
+		compile(projectFileArg(args), false)
+	},
+}
 
-		// Figure out which scripts to compile
-		r, err := p.GetScriptsToCompile()
-		if err != nil {
-			Fatal(err)
-		}
-		numberOfScripts := len(*r)
-		VerbosePrintf("Going to compile %d scripts.\n", numberOfScripts)
+// projectFileArg returns the project file from the command arguments, papy.yaml if missing
+func projectFileArg(args []string) string {
+	if len(args) >= 1 {
+		return args[0]
+	}
+	return "papy.yaml"
+}
 
-		// Determine workers
-		if workers <= 0 {
-			workers = runtime.NumCPU()
-		}
-		VerbosePrintf("Using %d workers\n", workers)
-
-		// Spawn workers
-		files := make(chan *papyrus.SourceScript, workers)
-		results := make(chan *papyrus.CompilerResult, workers)
-		outputDone := make(chan struct{})
-		var wg sync.WaitGroup
-		wg.Add(workers)
-		for i := 0; i < workers; i++ {
-			go p.CompileWorker(Config, &wg, files, results)
+// compile compiles the scripts of a project with multiple workers.
+// If all is true, all scripts are compiled, otherwise only the ones that changed.
+func compile(projectFile string, all bool) {
+	// Read yaml
+	p, err := papyrus.UnmarshalFile(projectFile, &Config)
+	if err != nil {
+		Fatal(err)
+	}
+
+	// Check folders
+	if err = p.CheckFolders(); err != nil {
+		Fatal(err)
+	}
+
+	// Check compiler
+	if s, err := os.Stat(Config.CompilerPath); err != nil || s.IsDir() {
+		FatalF("compiler check error: %v", err)
+	}
+	VerbosePrintf("Using compiler %s\n", Config.CompilerPath)
+
+	// Figure out which scripts to compile
+	var r *[]papyrus.SourceScript
+	if all {
+		r, err = p.GetAllScripts(Config)
+	} else {
+		r, err = p.GetScriptsToCompile(Config)
+	}
+	if err != nil {
+		Fatal(err)
+	}
+	numberOfScripts := len(*r)
+	VerbosePrintf("Going to compile %d scripts.\n", numberOfScripts)
+
+	// Determine workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	VerbosePrintf("Using %d workers\n", workers)
+
+	// Spawn workers
+	batches := papyrus.Batches(*r, workers)
+	VerbosePrintf("Split in %d batches\n", len(batches))
+	files := make(chan []*papyrus.SourceScript, workers)
+	results := make(chan *papyrus.CompilerResult, workers)
+	outputDone := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.CompileWorker(Config, &wg, files, results)
+	}
+
+	// Results printer goroutine
+	go func() {
+		for result := range results {
+			if result.Err != nil {
+				fmt.Fprintf(
+					os.Stderr,
+					"Error while compiling %s:\n%v\n%s",
+					result.SourceScript,
+					result.Err,
+					result.Output,
+				)
+			} else {
+				p.MarkCompiled(result.SourceScript)
+			}
 		}
 
-		// Results printer goroutine
-		go func() {
-			for result := range results {
-				if result.Err != nil {
-					fmt.Fprintf(
-						os.Stderr,
-						"Error while compiling %s:\n%v\n%s",
-						result.SourceScript,
-						result.Err,
-						result.Output,
-					)
-				}
-			}
+		// Notify main goroutine all results have been printed
+		outputDone <- struct{}{}
+	}()
 
-			// Notify main goroutine all results have been printed
-			outputDone <- struct{}{}
-		}()
+	// Send all batches to workers
+	for _, batch := range batches {
+		files <- batch
+	}
+	close(files)
 
-		// Send all files to workers
-		for _, file := range *r {
-			file := file
-			files <- &file
-		}
-		close(files)
+	// Wait for workers. No more results
+	wg.Wait()
+	close(results)
 
-		// Wait for workers. No more results
-		wg.Wait()
-		close(results)
+	// Wait for last results
+	<-outputDone
 
-		// Wait for last results
-		<-outputDone
+	// Remember what has been compiled, so it's not compiled again
+	if err := p.SaveBuildCache(); err != nil {
+		Fatal(err)
+	}
 
-		// Terminate the program
-		VerbosePrintln("Done!")
-	},
+	// Terminate the program
+	VerbosePrintln("Done!")
 }
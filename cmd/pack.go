@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/xnyo/papy/papyrus"
+)
+
+// Print conflicts resolution of aggregated archives, -r flag
+var printConflicts bool
+
+func init() {
+	packCmd.Flags().IntVarP(&workers, "workers", "w", 0, "number of compression workers. 0 for cpu cores.")
+	packCmd.Flags().BoolVarP(&printConflicts, "report", "r", false, "print which folder won each conflict in aggregated archives")
+	rootCmd.AddCommand(packCmd)
+}
+
+var packCmd = &cobra.Command{
+	Use:   "pack [project_file]",
+	Short: "Packs the BSA archives defined in the project file",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		// Read yaml
+		projectFile := "papy.yaml"
+		if len(args) >= 1 {
+			projectFile = args[0]
+		}
+		p, err := papyrus.UnmarshalFile(projectFile, &Config)
+		if err != nil {
+			Fatal(err)
+		}
+		if len(p.Archives) == 0 {
+			Fatal(fmt.Errorf("no archives present in the yaml file"))
+		}
+
+		for _, archive := range p.Archives {
+			if err := archive.CheckFolders(); err != nil {
+				Fatal(err)
+			}
+			w, err := archive.Writer()
+			if err != nil {
+				FatalF("invalid archive %s: %v", archive.Name, err)
+			}
+			w.Workers = workers
+
+			// Figure out which files to pack
+			root, conflicts, skipped, err := archive.Root()
+			if err != nil {
+				Fatal(err)
+			}
+			for _, path := range skipped {
+				VerbosePrintf("Skipping %s, files at the top level of a folder cannot be packed\n", path)
+			}
+			VerbosePrintf("Going to pack %d files in %s (%s).\n", root.FileCount(), archive.Name, w.Game)
+			if archive.Aggregate {
+				VerbosePrintf("Resolved %d conflicts.\n", len(conflicts))
+			}
+			if printConflicts {
+				for _, c := range conflicts {
+					fmt.Println(c)
+				}
+			}
+
+			// Check all paths before writing anything
+			if errs := w.Validate(root); len(errs) > 0 {
+				for _, err := range errs {
+					fmt.Fprintln(os.Stderr, err)
+				}
+				FatalF("cannot pack %s: %d invalid paths", archive.Name, len(errs))
+			}
+
+			// Split in multiple archives if needed
+			splits, err := archive.Split(w, root)
+			if err != nil {
+				Fatal(err)
+			}
+			for _, split := range splits {
+				name := split.Name(archive.Name)
+				fmt.Printf("Packing %s (%d files)\n", name, split.Root.FileCount())
+				if err := w.WriteFile(name, split.Root); err != nil {
+					Fatal(err)
+				}
+			}
+		}
+
+		// Terminate the program
+		VerbosePrintln("Done!")
+	},
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/xnyo/papy/bsa"
+)
+
+// Glob patterns of the files to extract, -i flag
+var unpackInclude []string
+
+func init() {
+	unpackCmd.Flags().IntVarP(&workers, "workers", "w", 0, "number of workers. 0 for cpu cores.")
+	unpackCmd.Flags().StringSliceVarP(&unpackInclude, "include", "i", nil, "glob patterns of the files to extract (eg: scripts/*.pex). all files if empty.")
+	rootCmd.AddCommand(unpackCmd)
+}
+
+// extractResult represents the result of the extraction of a file
+type extractResult struct {
+	File *bsa.File
+	Path string
+	Err  error
+}
+
+// extractWorker extracts the files received from the "c" channel to outputFolder.
+// It reports results in the "results" channel.
+func extractWorker(outputFolder string, wg *sync.WaitGroup, c <-chan *bsa.File, results chan<- *extractResult) {
+	defer wg.Done()
+	for f := range c {
+		path, err := f.ExtractTo(outputFolder)
+		results <- &extractResult{
+			File: f,
+			Path: path,
+			Err:  err,
+		}
+	}
+}
+
+// matchesAny returns true if the path of f matches any of the glob patterns
+func matchesAny(patterns []string, f *bsa.File) bool {
+	for _, pattern := range patterns {
+		if bsa.MatchPath(pattern, f.Path()) {
+			return true
+		}
+	}
+	return false
+}
+
+var unpackCmd = &cobra.Command{
+	Use:   "unpack archive [output_folder]",
+	Short: "Extracts all files, or the ones matching the include patterns, from a BSA archive",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		outputFolder := "."
+		if len(args) >= 2 {
+			outputFolder = args[1]
+		}
+		b, err := bsa.Open(args[0])
+		if err != nil {
+			Fatal(err)
+		}
+		defer b.Close()
+
+		// Figure out which files to extract
+		var toExtract []*bsa.File
+		for _, folder := range b.Root.Folders() {
+			for _, f := range folder.SortedFiles() {
+				if len(unpackInclude) == 0 || matchesAny(unpackInclude, f) {
+					toExtract = append(toExtract, f)
+				}
+			}
+		}
+		VerbosePrintf("Going to extract %d files to %s.\n", len(toExtract), outputFolder)
+
+		// Determine workers
+		if workers <= 0 {
+			workers = runtime.NumCPU()
+		}
+		VerbosePrintf("Using %d workers\n", workers)
+
+		// Spawn workers
+		files := make(chan *bsa.File, workers)
+		results := make(chan *extractResult, workers)
+		outputDone := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(workers)
+		for i := 0; i < workers; i++ {
+			go extractWorker(outputFolder, &wg, files, results)
+		}
+
+		// Results printer goroutine
+		go func() {
+			for result := range results {
+				if result.Err != nil {
+					fmt.Fprintf(os.Stderr, "Error while extracting %s:\n%v\n", result.File.Path(), result.Err)
+				} else {
+					VerbosePrintf("Extracted %s\n", result.Path)
+				}
+			}
+
+			// Notify main goroutine all results have been printed
+			outputDone <- struct{}{}
+		}()
+
+		// Send all files to workers
+		for _, f := range toExtract {
+			files <- f
+		}
+		close(files)
+
+		// Wait for workers. No more results
+		wg.Wait()
+		close(results)
+
+		// Wait for last results
+		<-outputDone
+
+		// Terminate the program
+		VerbosePrintln("Done!")
+	},
+}
@@ -0,0 +1,250 @@
+package papyrus
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/xnyo/papy/bsa"
+	"github.com/xnyo/papy/bsa/flags"
+)
+
+// Archive represents a BSA archive in a papy yaml project file
+type Archive struct {
+	// Name is the path of the archive that will be created (eg: MyMod.bsa)
+	Name string
+
+	// Folders is a slice of strings containing the paths of the folders we want to pack.
+	// Paths inside the archive are relative to these folders.
+	Folders []string
+
+	// Include is a slice of glob patterns. If it's not empty, only matching files are packed
+	Include []string
+
+	// Exclude is a slice of glob patterns. Matching files are never packed
+	Exclude []string
+
+	// Game is the game the archive is built for (le, sse or fo4, sse if empty)
+	Game string
+
+	// Compress is true if we want to compress the archive
+	Compress bool
+
+	// ForceCompressed is a slice of glob patterns. Matching files are always compressed
+	ForceCompressed []string `yaml:"force_compressed"`
+
+	// ForceUncompressed is a slice of glob patterns. Matching files are never compressed
+	ForceUncompressed []string `yaml:"force_uncompressed"`
+
+	// ArchiveFlags is a slice of strings containing the names of the archive
+	// flags to set, in addition to the ones set in official archives (eg: embed_file_names)
+	ArchiveFlags []string `yaml:"archive_flags"`
+
+	// MaxSize is the maximum size of each archive, in bytes. Bigger archives are split
+	// in multiple archives. If it's 0, the maximum size the engine is able to load is used.
+	MaxSize int64 `yaml:"max_size"`
+
+	// Textures is true if the archive is a Fallout 4 texture archive (DX10).
+	// All packed files must be DDS textures.
+	Textures bool
+
+	// Aggregate is true if the folders are different mods that have to be merged
+	// in a single archive set. When the same file is present in multiple folders,
+	// the one in the last folder wins, like in Mod Organizer's priority order.
+	// If it's false, the same file in multiple folders is an error.
+	Aggregate bool
+}
+
+// Conflict represents a file present in multiple folders of an aggregated archive
+type Conflict struct {
+	// Path is the path of the file inside the archive
+	Path string
+
+	// Winner is the folder the packed file comes from
+	Winner string
+
+	// Losers are the other folders containing the file, from the highest priority
+	Losers []string
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s: %s (overrides %s)", c.Path, c.Winner, strings.Join(c.Losers, ", "))
+}
+
+// Split returns the archives the files in root will be packed in, so they don't
+// exceed the maximum size. Use bsa.Split.Name to get the name of each archive.
+func (a *Archive) Split(w *bsa.Writer, root *bsa.Root) ([]bsa.Split, error) {
+	maxSize := a.MaxSize
+	if maxSize <= 0 {
+		maxSize = bsa.MaxLoadableSize
+	}
+	splits, err := w.Split(root, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("cannot split archive %s: %v", a.Name, err)
+	}
+	return splits, nil
+}
+
+// absPaths turns all relative paths to absolute paths
+func (a *Archive) absPaths() error {
+	v, err := filepath.Abs(a.Name)
+	if err != nil {
+		return err
+	}
+	a.Name = v
+	for i := 0; i < len(a.Folders); i++ {
+		v, err := filepath.Abs(a.Folders[i])
+		if err != nil {
+			return err
+		}
+		a.Folders[i] = v
+	}
+	return nil
+}
+
+// CheckFolders makes sure that all folders of the archive exist
+func (a *Archive) CheckFolders() error {
+	if len(a.Folders) == 0 {
+		return fmt.Errorf("no folders to pack in archive %s", a.Name)
+	}
+	for _, folder := range a.Folders {
+		if err := checkFolder(folder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writer returns a bsa.Writer configured with the archive game and flags
+func (a *Archive) Writer() (*bsa.Writer, error) {
+	game, err := flags.ParseGame(a.Game)
+	if err != nil {
+		return nil, err
+	}
+	if a.Textures && game != flags.Fallout4 {
+		return nil, fmt.Errorf("texture archives can only be written for %s", flags.Fallout4)
+	}
+	w := bsa.NewWriter(game)
+	w.Textures = a.Textures
+	for _, name := range a.ArchiveFlags {
+		f, err := flags.ParseArchiveFlag(name)
+		if err != nil {
+			return nil, err
+		}
+		w.ArchiveFlags |= f
+	}
+	if a.Compress {
+		w.ArchiveFlags |= flags.Compressed
+	}
+	if len(a.ForceCompressed) > 0 || len(a.ForceUncompressed) > 0 {
+		w.ShouldCompress = a.shouldCompress
+	}
+	return w, nil
+}
+
+// Root walks the archive folders and returns a bsa.Root
+// containing all the files that have to be packed.
+// If the archive is aggregated, it also returns how conflicts have been resolved.
+// Files at the top level of the folders (eg: meta.ini and plugins in Mod Organizer
+// mod folders) cannot be packed, so they are skipped and their paths returned.
+// The archive itself and all the archives it can be split into are never packed.
+func (a *Archive) Root() (*bsa.Root, []Conflict, []string, error) {
+	type source struct {
+		folder string
+		path   string
+	}
+
+	// Relative path -> files with that path, from the lowest priority
+	found := make(map[string][]source)
+	var skipped []string
+	for _, folder := range a.Folders {
+		err := filepath.Walk(folder, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(folder, p)
+			if err != nil {
+				return err
+			}
+			rel = strings.ToLower(filepath.ToSlash(rel))
+			if bsa.IsSplitName(a.Name, p) || !a.matches(rel) {
+				return nil
+			}
+			if !strings.Contains(rel, "/") {
+				skipped = append(skipped, p)
+				return nil
+			}
+			if others, ok := found[rel]; ok && !a.Aggregate {
+				return fmt.Errorf("%s is present in both %s and %s", rel, others[0].folder, folder)
+			}
+			found[rel] = append(found[rel], source{folder, p})
+			return nil
+		})
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("cannot walk folder %s: %v", folder, err)
+		}
+	}
+
+	paths := make([]string, 0, len(found))
+	for rel := range found {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	root := bsa.NewRoot()
+	var conflicts []Conflict
+	for _, rel := range paths {
+		sources := found[rel]
+		winner := sources[len(sources)-1]
+		if len(sources) > 1 {
+			c := Conflict{Path: rel, Winner: winner.folder}
+			for i := len(sources) - 2; i >= 0; i-- {
+				c.Losers = append(c.Losers, sources[i].folder)
+			}
+			conflicts = append(conflicts, c)
+		}
+		f, err := bsa.NewLooseFile(winner.path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if err := root.AddFile(rel, f); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return root, conflicts, skipped, nil
+}
+
+// shouldCompress returns true if f must be compressed,
+// according to the force_compressed and force_uncompressed glob patterns
+func (a *Archive) shouldCompress(f *bsa.File) bool {
+	if matchAny(a.ForceUncompressed, f.Path()) {
+		return false
+	}
+	if matchAny(a.ForceCompressed, f.Path()) {
+		return true
+	}
+	return a.Compress
+}
+
+// matches returns true if the relative path p must be packed,
+// according to the include and exclude glob patterns
+func (a *Archive) matches(p string) bool {
+	if len(a.Include) > 0 && !matchAny(a.Include, p) {
+		return false
+	}
+	return !matchAny(a.Exclude, p)
+}
+
+// matchAny returns true if the relative path p matches any of the glob patterns
+func matchAny(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if bsa.MatchPath(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
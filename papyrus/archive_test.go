@@ -0,0 +1,166 @@
+package papyrus
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/xnyo/papy/bsa"
+)
+
+// rootPaths returns the contents of the files in the archive root by path, the conflicts and the skipped files
+func rootPaths(t *testing.T, a *Archive) (map[string]string, []Conflict, []string) {
+	t.Helper()
+	root, conflicts, skipped, err := a.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make(map[string]string)
+	for _, folder := range root.Folders() {
+		for _, f := range folder.SortedFiles() {
+			r, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths[f.Path()] = string(data)
+		}
+	}
+	return paths, conflicts, skipped
+}
+
+func TestArchiveRootConflicts(t *testing.T) {
+	dir := t.TempDir()
+	base, patch, fix := filepath.Join(dir, "base"), filepath.Join(dir, "patch"), filepath.Join(dir, "fix")
+	writeFiles(t, base, map[string]string{
+		"meshes/a.nif":   "base",
+		"meshes/b.nif":   "base",
+		"meshes/c.nif":   "base",
+		"textures/a.dds": "base",
+		"meta.ini":       "base",
+	})
+	writeFiles(t, patch, map[string]string{
+		"meshes/a.nif":   "patch",
+		"Meshes/B.nif":   "patch",
+		"textures/b.dds": "patch",
+		"meta.ini":       "patch",
+	})
+	writeFiles(t, fix, map[string]string{
+		"meshes/a.nif": "fix",
+	})
+
+	a := &Archive{
+		Name:      filepath.Join(dir, "MyMod.bsa"),
+		Folders:   []string{base, patch, fix},
+		Aggregate: true,
+	}
+	paths, conflicts, skipped := rootPaths(t, a)
+
+	// The last folder wins, names are compared ignoring case
+	expected := map[string]string{
+		`meshes\a.nif`:   "fix",
+		`meshes\b.nif`:   "patch",
+		`meshes\c.nif`:   "base",
+		`textures\a.dds`: "base",
+		`textures\b.dds`: "patch",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("packed %v, expected %v", paths, expected)
+	}
+	expectedConflicts := []Conflict{
+		{Path: "meshes/a.nif", Winner: fix, Losers: []string{patch, base}},
+		{Path: "meshes/b.nif", Winner: patch, Losers: []string{base}},
+	}
+	if !reflect.DeepEqual(conflicts, expectedConflicts) {
+		t.Errorf("conflicts are %v, expected %v", conflicts, expectedConflicts)
+	}
+	expectedSkipped := []string{filepath.Join(base, "meta.ini"), filepath.Join(patch, "meta.ini")}
+	if !reflect.DeepEqual(skipped, expectedSkipped) {
+		t.Errorf("skipped %v, expected %v", skipped, expectedSkipped)
+	}
+
+	// Without aggregation, the same file in multiple folders is an error
+	a.Aggregate = false
+	if _, _, _, err := a.Root(); err == nil {
+		t.Error("conflicts without aggregation are not an error")
+	}
+}
+
+func TestArchiveRootSkipsArchives(t *testing.T) {
+	dir := t.TempDir()
+	// The archives are written inside the packed folder, by a previous run
+	writeFiles(t, dir, map[string]string{
+		"meshes/a.nif":                    "",
+		"data/MyMod.bsa":                  "",
+		"data/MyMod0.bsa":                 "",
+		"data/MyMod1.bsa":                 "",
+		"data/MyMod - Textures.bsa":       "",
+		"data/MyMod - Textures0.bsa":      "",
+		"data/mymod2.BSA":                 "",
+		"data/MyMod - Textures.bsa.bak":   "",
+		"data/MyModPatch.bsa":             "",
+		"data/Other.bsa":                  "",
+		"data/other/MyMod0.bsa":           "",
+		"data/MyMod - Animations.bsa":     "",
+		"data/MyMod - Textures Extra.bsa": "",
+	})
+	a := &Archive{
+		Name:    filepath.Join(dir, "data", "MyMod.bsa"),
+		Folders: []string{dir},
+	}
+	paths, _, _ := rootPaths(t, a)
+	expected := map[string]string{
+		`meshes\a.nif`:                    "",
+		`data\mymod - textures.bsa.bak`:   "",
+		`data\mymodpatch.bsa`:             "",
+		`data\other.bsa`:                  "",
+		`data\other\mymod0.bsa`:           "",
+		`data\mymod - animations.bsa`:     "",
+		`data\mymod - textures extra.bsa`: "",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("packed %v, expected only %v", paths, expected)
+	}
+}
+
+func TestArchiveShouldCompress(t *testing.T) {
+	tests := []struct {
+		path string
+		// compressed is whether the file is compressed in an uncompressed and in a compressed archive
+		compressed [2]bool
+	}{
+		{`textures\a.dds`, [2]bool{true, true}},
+		{`meshes\armor\a.nif`, [2]bool{false, false}},
+		{`meshes\a.nif`, [2]bool{false, true}},
+		{`sound\music\a.xwm`, [2]bool{true, true}},
+		// Force uncompressed wins over force compressed
+		{`sound\music\a.wav`, [2]bool{false, false}},
+		{`scripts\a.pex`, [2]bool{false, true}},
+	}
+	for i, compress := range []bool{false, true} {
+		a := &Archive{
+			Compress:          compress,
+			ForceCompressed:   []string{"*.dds", "sound/music/*"},
+			ForceUncompressed: []string{"meshes/*/*.nif", "*.wav"},
+		}
+		w, err := a.Writer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		root := bsa.NewRoot()
+		for _, tt := range tests {
+			f := &bsa.File{}
+			if err := root.AddFile(tt.path, f); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.ShouldCompress(f); got != tt.compressed[i] {
+				t.Errorf("compress %v: %s compressed is %v, expected %v", compress, tt.path, got, tt.compressed[i])
+			}
+		}
+	}
+}
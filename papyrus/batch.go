@@ -0,0 +1,216 @@
+package papyrus
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/xnyo/papy/config"
+)
+
+// Batches splits scripts in batches that can be compiled by a single compiler process.
+// Scripts in the same batch have the same source and destination folder, and batches
+// are at most len(scripts)/workers scripts long, so all workers have something to do.
+func Batches(scripts []SourceScript, workers int) [][]*SourceScript {
+	if workers <= 0 {
+		workers = 1
+	}
+	maxSize := (len(scripts) + workers - 1) / workers
+	var batches [][]*SourceScript
+	current := make(map[string]int)
+	for i := range scripts {
+		s := &scripts[i]
+		key := filepath.Dir(s.SourcePath) + "|" + s.DestinationFolder
+		j, ok := current[key]
+		if !ok || len(batches[j]) >= maxSize {
+			j = len(batches)
+			current[key] = j
+			batches = append(batches, nil)
+		}
+		batches[j] = append(batches[j], s)
+	}
+	return batches
+}
+
+// backupPex renames the compiled script at path, if it exists, so a compiled script
+// written by the compiler can be told apart from the old one, even if they have the
+// same size and timestamp. It returns the path of the backup, or "" if there was no
+// compiled script.
+func backupPex(path string) (string, error) {
+	backup := path + ".bak"
+	if err := os.Rename(path, backup); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("cannot rename %s: %v", path, err)
+	}
+	return backup, nil
+}
+
+// restorePex returns true if the compiler wrote the compiled script at path.
+// If it did, the backup is deleted, otherwise it's restored, so a script that
+// failed to compile keeps its old compiled script.
+func restorePex(path string, backup string) (bool, error) {
+	_, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("cannot stat %s: %v", path, err)
+	}
+	compiled := err == nil
+	if backup == "" {
+		return compiled, nil
+	}
+	if compiled {
+		err = os.Remove(backup)
+	} else {
+		err = os.Rename(backup, path)
+	}
+	if err != nil {
+		return compiled, fmt.Errorf("cannot restore %s: %v", path, err)
+	}
+	return compiled, nil
+}
+
+// compileBatch compiles multiple scripts with the same source and destination folder
+// with a single compiler process, so the compiler parses the imported scripts only once.
+// The compiler accepts a single script, or a whole folder with the -all flag, so the
+// sources are copied to a temporary folder that contains only the scripts of the batch.
+// The temporary folder comes first in the imports, so scripts in the batch that refer
+// to each other see the same sources that are being compiled.
+// Old compiled scripts are moved out of the way while compiling, each script is compiled
+// successfully if the compiler wrote its compiled script, and its result contains the
+// lines of the compiler output that refer to it.
+func (p *Project) compileBatch(config config.Configuration, batch []*SourceScript) []*CompilerResult {
+	results := make([]*CompilerResult, len(batch))
+	fail := func(err error) []*CompilerResult {
+		for i, s := range batch {
+			results[i] = &CompilerResult{SourceScript: s, Err: err}
+		}
+		return results
+	}
+	tmp, err := ioutil.TempDir("", "papy")
+	if err != nil {
+		return fail(fmt.Errorf("cannot create temporary folder: %v", err))
+	}
+	defer os.RemoveAll(tmp)
+	for _, s := range batch {
+		if err := copyFile(s.SourcePath, filepath.Join(tmp, filepath.Base(s.SourcePath))); err != nil {
+			return fail(err)
+		}
+	}
+	pexPaths := make([]string, len(batch))
+	backups := make([]string, len(batch))
+	for i, s := range batch {
+		name := filepath.Base(s.SourcePath)
+		pexPaths[i] = filepath.Join(s.DestinationFolder, strings.TrimSuffix(name, filepath.Ext(name))+".pex")
+		if backups[i], err = backupPex(pexPaths[i]); err != nil {
+			for j := 0; j < i; j++ {
+				restorePex(pexPaths[j], backups[j])
+			}
+			return fail(err)
+		}
+	}
+
+	args := []string{
+		tmp,
+		"-all",
+		arg{"o", batch[0].DestinationFolder}.String(),
+	}
+	args = append(args, p.argsWithImports(append(append([]string{tmp}, p.Imports...), p.importRoots...))...)
+	compilerCmd := exec.Command(config.CompilerPath, args...)
+	compilerOut, err := compilerCmd.CombinedOutput()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		for i := range batch {
+			restorePex(pexPaths[i], backups[i])
+		}
+		return fail(fmt.Errorf("cannot start compiler: %v", err))
+	}
+	// Errors refer to the copies of the sources, show the original paths instead
+	compilerOutput := replaceFold(string(compilerOut), tmp, filepath.Dir(batch[0].SourcePath))
+	lines := strings.Split(strings.TrimRight(strings.Replace(compilerOutput, "\r\n", "\n", -1), "\n"), "\n")
+
+	// The whole output is attached only to the first failed script it may refer to
+	var outputOwner *SourceScript
+	for i, s := range batch {
+		result := CompilerResult{
+			SourceScript: s,
+			Command:      strings.Join(args, " "),
+		}
+		var output []string
+		for _, line := range lines {
+			if indexFold(line, s.SourcePath) >= 0 {
+				output = append(output, line)
+			}
+		}
+		compiled, restoreErr := restorePex(pexPaths[i], backups[i])
+		if restoreErr != nil {
+			result.Err = restoreErr
+		} else if !compiled {
+			result.Err = err
+			if result.Err == nil {
+				result.Err = fmt.Errorf("no compiled script generated")
+			}
+			if len(output) == 0 {
+				// Nothing refers to this script, the whole output may explain why
+				if outputOwner == nil {
+					outputOwner = s
+					output = lines
+				} else {
+					result.Err = fmt.Errorf("%v, see the compiler output of %s", result.Err, filepath.Base(outputOwner.SourcePath))
+				}
+			}
+		}
+		if len(output) > 0 {
+			result.Output = strings.Join(output, "\n") + "\n"
+		}
+		results[i] = &result
+	}
+	return results
+}
+
+// indexFold returns the index of the first occurrence of substr in s, ignoring case,
+// or -1 if substr is not present in s
+func indexFold(s string, substr string) int {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if strings.EqualFold(s[i:i+len(substr)], substr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// replaceFold replaces all the occurrences of old in s with new, ignoring case
+func replaceFold(s string, old string, new string) string {
+	if old == "" {
+		return s
+	}
+	var b strings.Builder
+	for i := indexFold(s, old); i >= 0; i = indexFold(s, old) {
+		b.WriteString(s[:i])
+		b.WriteString(new)
+		s = s[i+len(old):]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// copyFile copies the file at src to dst
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("cannot open %s: %v", src, err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("cannot create %s: %v", dst, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("cannot copy %s: %v", src, err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,253 @@
+package papyrus
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xnyo/papy/config"
+)
+
+// fakeCompilerEnv is set when the test binary is started as a fake compiler
+const fakeCompilerEnv = "PAPY_FAKE_COMPILER"
+
+// pexTime is the timestamp of all the compiled scripts written by the fake compiler,
+// like on a file system with coarse timestamps
+var pexTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeCompilerEnv) != "" {
+		os.Exit(fakeCompiler(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// fakeCompiler compiles the scripts in a folder, like the compiler with -all.
+// Compiled scripts are a copy of the sources. Scripts containing "error" fail
+// with an error that refers to them (in uppercase), scripts containing "crash"
+// fail with an error that refers to no script.
+// The folder must be the first import, or nothing is compiled.
+func fakeCompiler(args []string) int {
+	var out, imports string
+	for _, a := range args {
+		switch {
+		case strings.HasPrefix(a, "-o="):
+			out = a[len("-o="):]
+		case strings.HasPrefix(a, "-i="):
+			imports = a[len("-i="):]
+		}
+	}
+	if len(args) < 2 || args[1] != "-all" || strings.Split(imports, ";")[0] != args[0] {
+		fmt.Printf("unexpected arguments %q\n", args)
+		return 2
+	}
+	files, err := filepath.Glob(filepath.Join(args[0], "*.psc"))
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	status := 0
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		switch {
+		case bytes.Contains(data, []byte("error")):
+			fmt.Printf("%s(2,1): unknown type error\r\n", strings.ToUpper(f))
+			status = 1
+		case bytes.Contains(data, []byte("crash")):
+			fmt.Printf("Compiler crashed\r\n")
+			status = 1
+		default:
+			pex := filepath.Join(out, strings.TrimSuffix(filepath.Base(f), ".psc")+".pex")
+			if err := ioutil.WriteFile(pex, data, 0644); err != nil {
+				fmt.Println(err)
+				return 2
+			}
+			if err := os.Chtimes(pex, pexTime, pexTime); err != nil {
+				fmt.Println(err)
+				return 2
+			}
+		}
+	}
+	return status
+}
+
+// fakeCompilerConfig returns a configuration that runs the fake compiler
+func fakeCompilerConfig(t *testing.T) config.Configuration {
+	compiler, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(fakeCompilerEnv, "1")
+	t.Cleanup(func() { os.Unsetenv(fakeCompilerEnv) })
+	return config.Configuration{CompilerPath: compiler}
+}
+
+// compileTestBatch writes sources to a source folder and old compiled scripts to
+// an output folder, and compiles all sources in a single batch with the fake compiler
+func compileTestBatch(t *testing.T, sources map[string]string, pex map[string]string) (string, string, []*CompilerResult) {
+	src, out := t.TempDir(), t.TempDir()
+	writeFiles(t, src, sources)
+	writeFiles(t, out, pex)
+	for name := range pex {
+		if err := os.Chtimes(filepath.Join(out, name), pexTime, pexTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var batch []*SourceScript
+	for name := range sources {
+		batch = append(batch, &SourceScript{filepath.Join(src, name), out})
+	}
+	p := &Project{Folders: []string{src}, Imports: []string{src}, OutputFolders: []string{out}}
+	return src, out, p.compileBatch(fakeCompilerConfig(t), batch)
+}
+
+func TestCompileBatch(t *testing.T) {
+	src, out, results := compileTestBatch(t, map[string]string{
+		"Good.psc":      "ScriptName Good\n",
+		"Recompile.psc": "ScriptName Recompile\n",
+		"Broken.psc":    "ScriptName Broken\nerror\n",
+	}, map[string]string{
+		// The same compiled script, with the same size and timestamp
+		"Recompile.pex": "ScriptName Recompile\n",
+		"Broken.pex":    "old compiled script",
+	})
+	for _, result := range results {
+		name := filepath.Base(result.SourceScript.SourcePath)
+		if name == "Broken.psc" {
+			if result.Err == nil {
+				t.Errorf("%s: compiled without errors", name)
+			}
+			expected := filepath.Join(src, "BROKEN.PSC") + "(2,1): unknown type error\n"
+			if result.Output != expected {
+				t.Errorf("%s: output is %q, expected %q", name, result.Output, expected)
+			}
+			continue
+		}
+		if result.Err != nil || result.Output != "" {
+			t.Errorf("%s: error %v, output %q", name, result.Err, result.Output)
+		}
+	}
+
+	// A script that failed keeps its old compiled script, no backups are left behind
+	if data, err := ioutil.ReadFile(filepath.Join(out, "Broken.pex")); err != nil || string(data) != "old compiled script" {
+		t.Errorf("old compiled script not restored: %q, %v", data, err)
+	}
+	if backups, _ := filepath.Glob(filepath.Join(out, "*.bak")); len(backups) > 0 {
+		t.Errorf("backups left in the output folder: %v", backups)
+	}
+}
+
+func TestCompileBatchUnattributedOutput(t *testing.T) {
+	_, _, results := compileTestBatch(t, map[string]string{
+		"A.psc":    "ScriptName A\ncrash\n",
+		"B.psc":    "ScriptName B\ncrash\n",
+		"Good.psc": "ScriptName Good\n",
+	}, nil)
+	var owner string
+	for _, result := range results {
+		name := filepath.Base(result.SourceScript.SourcePath)
+		switch {
+		case name == "Good.psc":
+			if result.Err != nil || result.Output != "" {
+				t.Errorf("%s: error %v, output %q", name, result.Err, result.Output)
+			}
+		case owner == "":
+			// The first failed script gets the whole output
+			owner = name
+			if result.Err == nil || result.Output != "Compiler crashed\nCompiler crashed\n" {
+				t.Errorf("%s: error %v, output %q", name, result.Err, result.Output)
+			}
+		default:
+			if result.Err == nil || !strings.Contains(result.Err.Error(), "see the compiler output of "+owner) || result.Output != "" {
+				t.Errorf("%s: error %v, output %q", name, result.Err, result.Output)
+			}
+		}
+	}
+}
+
+func TestBatches(t *testing.T) {
+	script := func(dir string, name string, out string) SourceScript {
+		return SourceScript{filepath.Join(dir, name+".psc"), out}
+	}
+	scripts := []SourceScript{
+		script("a", "A1", "out"),
+		script("b", "B1", "out"),
+		script("a", "A2", "out"),
+		script("a", "A3", "other"),
+		script("a", "A4", "out"),
+		script("a", "A5", "out"),
+		script("b", "B2", "out"),
+		script("a", "A6", "out"),
+	}
+	tests := []struct {
+		workers  int
+		expected [][]string
+	}{
+		{0, [][]string{{"A1", "A2", "A4", "A5", "A6"}, {"B1", "B2"}, {"A3"}}},
+		{1, [][]string{{"A1", "A2", "A4", "A5", "A6"}, {"B1", "B2"}, {"A3"}}},
+		{2, [][]string{{"A1", "A2", "A4", "A5"}, {"B1", "B2"}, {"A3"}, {"A6"}}},
+		{4, [][]string{{"A1", "A2"}, {"B1", "B2"}, {"A3"}, {"A4", "A5"}, {"A6"}}},
+		{8, [][]string{{"A1"}, {"B1"}, {"A2"}, {"A3"}, {"A4"}, {"A5"}, {"B2"}, {"A6"}}},
+	}
+	for _, tt := range tests {
+		var got [][]string
+		for _, batch := range Batches(scripts, tt.workers) {
+			var names []string
+			for _, s := range batch {
+				names = append(names, strings.TrimSuffix(filepath.Base(s.SourcePath), ".psc"))
+			}
+			got = append(got, names)
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%d workers: batches are %v, expected %v", tt.workers, got, tt.expected)
+		}
+	}
+}
+
+func TestIndexFold(t *testing.T) {
+	tests := []struct {
+		s      string
+		substr string
+		index  int
+	}{
+		{`C:\Mods\Src\Quest.psc(1,1): error`, `c:\mods\src\quest.psc`, 0},
+		{`Error in C:\MODS\SRC\QUEST.PSC`, `C:\Mods\Src\Quest.psc`, 9},
+		{`C:\Mods\Src\QuestAlias.psc(1,1): error`, `C:\Mods\Src\Quest.psc`, -1},
+		{`short`, `longer string`, -1},
+		{`anything`, ``, 0},
+	}
+	for _, tt := range tests {
+		if got := indexFold(tt.s, tt.substr); got != tt.index {
+			t.Errorf("indexFold(%q, %q) = %d, expected %d", tt.s, tt.substr, got, tt.index)
+		}
+	}
+}
+
+func TestReplaceFold(t *testing.T) {
+	tests := []struct {
+		s        string
+		old      string
+		new      string
+		expected string
+	}{
+		{`C:\TEMP\PAPY1\A.psc(1,1): error`, `C:\Temp\papy1`, `C:\Src`, `C:\Src\A.psc(1,1): error`},
+		{`c:\temp\papy1\A.psc and C:\Temp\Papy1\B.psc`, `C:\Temp\papy1`, `C:\Src`, `C:\Src\A.psc and C:\Src\B.psc`},
+		{`no paths here`, `C:\Temp\papy1`, `C:\Src`, `no paths here`},
+		{`unchanged`, ``, `C:\Src`, `unchanged`},
+	}
+	for _, tt := range tests {
+		if got := replaceFold(tt.s, tt.old, tt.new); got != tt.expected {
+			t.Errorf("replaceFold(%q, %q, %q) = %q, expected %q", tt.s, tt.old, tt.new, got, tt.expected)
+		}
+	}
+}
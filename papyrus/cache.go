@@ -0,0 +1,161 @@
+package papyrus
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+)
+
+// cacheFile is the path of the build cache, relative to the project root
+var cacheFile = filepath.Join(".papy", "cache")
+
+// buildCache is the persistent build database.
+// It stores what every script was last compiled from, so scripts are compiled
+// only when something relevant changed, regardless of file timestamps.
+type buildCache struct {
+	// Compiler is the hash of the compiler binary
+	Compiler string `json:"compiler"`
+
+	// Flags are the compiler flags shared by all scripts
+	Flags string `json:"flags"`
+
+	// Scripts are the scripts compiled successfully, by source path
+	Scripts map[string]*cacheEntry `json:"scripts"`
+
+	// Imports are the scripts in the import folders parsed in the last build, by path.
+	// They are parsed again only if their source changed.
+	Imports map[string]*importEntry `json:"imports"`
+}
+
+// cacheEntry represents a script compiled successfully
+type cacheEntry struct {
+	// Hash is the hash of the source
+	Hash string `json:"hash"`
+
+	// Output is the folder the script has been compiled to
+	Output string `json:"output"`
+
+	// Dependencies are the hashes of the sources of the project scripts
+	// it depends on, by script name
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+// importEntry represents a parsed script in the import folders
+type importEntry struct {
+	// Hash is the hash of the source
+	Hash string `json:"hash"`
+
+	// Name is the lowercase script name
+	Name string `json:"name"`
+
+	// References are the lowercase identifiers used in the script
+	References []string `json:"references"`
+}
+
+// newImportEntry returns the cache entry of a parsed imported script
+func newImportEntry(info *scriptInfo) *importEntry {
+	entry := importEntry{
+		Hash:       info.hash,
+		Name:       info.name,
+		References: make([]string, 0, len(info.references)),
+	}
+	for ref := range info.references {
+		entry.References = append(entry.References, ref)
+	}
+	sort.Strings(entry.References)
+	return &entry
+}
+
+// info returns the parsed script stored in the entry
+func (e *importEntry) info() *scriptInfo {
+	info := scriptInfo{
+		name:       e.Name,
+		hash:       e.Hash,
+		references: make(map[string]struct{}, len(e.References)),
+	}
+	for _, ref := range e.References {
+		info.references[ref] = struct{}{}
+	}
+	return &info
+}
+
+// loadBuildCache reads the build cache at path.
+// An empty cache is returned if the file does not exist.
+func loadBuildCache(path string) (*buildCache, error) {
+	cache := buildCache{
+		Scripts: make(map[string]*cacheEntry),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &cache, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read build cache %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, fmt.Errorf("cannot parse build cache %s: %v", path, err)
+	}
+	if cache.Scripts == nil {
+		cache.Scripts = make(map[string]*cacheEntry)
+	}
+	return &cache, nil
+}
+
+// save writes the build cache to path, creating its folder if needed.
+// The cache is written to a temporary file first, so it's never left half written.
+func (c *buildCache) save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("cannot create build cache folder: %v", err)
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("cannot write build cache %s: %v", path, err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("cannot write build cache %s: %v", path, err)
+	}
+	return nil
+}
+
+// reset discards all scripts if the compiler or the flags changed,
+// because all scripts have to be compiled again.
+// Parsed imported scripts are kept, they don't depend on the compiler.
+func (c *buildCache) reset(compiler string, flags string) {
+	if c.Compiler != compiler || c.Flags != flags {
+		c.Compiler = compiler
+		c.Flags = flags
+		c.Scripts = make(map[string]*cacheEntry)
+	}
+}
+
+// upToDate returns true if the script has been compiled from the same source,
+// to the same folder and with the same dependencies as entry
+func (c *buildCache) upToDate(sourcePath string, entry *cacheEntry) bool {
+	cached, ok := c.Scripts[sourcePath]
+	return ok && cached.Hash == entry.Hash && cached.Output == entry.Output &&
+		reflect.DeepEqual(cached.Dependencies, entry.Dependencies)
+}
+
+// hashFile returns the sha256 of the file at path
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot open %s: %v", path, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("cannot read %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,166 @@
+package papyrus
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/xnyo/papy/config"
+)
+
+// writeFiles writes files, by path relative to dir, creating their folders
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for p, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBuildCache(t *testing.T) {
+	compiled := cacheEntry{
+		Hash:         "source",
+		Output:       "out",
+		Dependencies: map[string]string{"parent": "parent source", "actor": "imported source"},
+	}
+	tests := []struct {
+		name     string
+		compiler string
+		flags    string
+		hash     string
+		output   string
+		deps     map[string]string
+		upToDate bool
+	}{
+		{"unchanged", "compiler", "flags", "source", "out", map[string]string{"parent": "parent source", "actor": "imported source"}, true},
+		{"source edit", "compiler", "flags", "edited", "out", map[string]string{"parent": "parent source", "actor": "imported source"}, false},
+		{"project dependency edit", "compiler", "flags", "source", "out", map[string]string{"parent": "edited", "actor": "imported source"}, false},
+		{"import edit", "compiler", "flags", "source", "out", map[string]string{"parent": "parent source", "actor": "edited"}, false},
+		{"new dependency", "compiler", "flags", "source", "out", map[string]string{"parent": "parent source", "actor": "imported source", "other": "other"}, false},
+		{"output folder change", "compiler", "flags", "source", "other out", map[string]string{"parent": "parent source", "actor": "imported source"}, false},
+		{"flags change", "compiler", "flags -o", "source", "out", map[string]string{"parent": "parent source", "actor": "imported source"}, false},
+		{"compiler change", "new compiler", "flags", "source", "out", map[string]string{"parent": "parent source", "actor": "imported source"}, false},
+	}
+	for _, tt := range tests {
+		c := buildCache{
+			Compiler: "compiler",
+			Flags:    "flags",
+			Scripts:  map[string]*cacheEntry{"script.psc": &compiled},
+		}
+		c.reset(tt.compiler, tt.flags)
+		entry := &cacheEntry{Hash: tt.hash, Output: tt.output, Dependencies: tt.deps}
+		if got := c.upToDate("script.psc", entry); got != tt.upToDate {
+			t.Errorf("%s: upToDate = %v, expected %v", tt.name, got, tt.upToDate)
+		}
+		if got := c.upToDate("other.psc", entry); got {
+			t.Errorf("%s: a script never compiled is up to date", tt.name)
+		}
+	}
+}
+
+func TestGetScriptsToCompile(t *testing.T) {
+	dir := t.TempDir()
+	src, imports, out := filepath.Join(dir, "src"), filepath.Join(dir, "imports"), filepath.Join(dir, "out")
+	writeFiles(t, src, map[string]string{
+		"Base.psc":  "ScriptName Base extends Quest\nint Property X auto\n",
+		"Child.psc": "ScriptName Child extends Base\nActor Property Target auto\n",
+		"Other.psc": "ScriptName Other\n",
+	})
+	writeFiles(t, imports, map[string]string{
+		"Actor.psc":           "ScriptName Actor extends ObjectReference\n",
+		"ObjectReference.psc": "ScriptName ObjectReference extends Form\n",
+		"Form.psc":            "ScriptName Form\n",
+		"Quest.psc":           "ScriptName Quest extends Form\n",
+	})
+	if err := os.MkdirAll(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	compiler := filepath.Join(dir, "PapyrusCompiler.exe")
+	writeFiles(t, dir, map[string]string{"PapyrusCompiler.exe": "v1"})
+	cfg := config.Configuration{CompilerPath: compiler}
+	optimize := false
+
+	// build returns the names of the scripts to compile, and pretends to compile them
+	build := func() []string {
+		p := &Project{
+			Folders:       []string{src},
+			Imports:       []string{imports, src},
+			OutputFolders: []string{out},
+			Optimize:      optimize,
+			root:          dir,
+		}
+		scripts, err := p.GetScriptsToCompile(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for i := range *scripts {
+			s := &(*scripts)[i]
+			name := filepath.Base(s.SourcePath)
+			names = append(names, name)
+			writeFiles(t, s.DestinationFolder, map[string]string{name[:len(name)-4] + ".pex": ""})
+			p.MarkCompiled(s)
+		}
+		if err := p.SaveBuildCache(); err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	all := []string{"Base.psc", "Child.psc", "Other.psc"}
+	tests := []struct {
+		name     string
+		change   func()
+		expected []string
+	}{
+		{"first build", func() {}, all},
+		{"unchanged", func() {}, nil},
+		{"same content written again", func() {
+			writeFiles(t, src, map[string]string{"Other.psc": "ScriptName Other\n"})
+		}, nil},
+		{"source edit", func() {
+			writeFiles(t, src, map[string]string{"Other.psc": "ScriptName Other\nint x\n"})
+		}, []string{"Other.psc"}},
+		{"parent edit", func() {
+			writeFiles(t, src, map[string]string{"Base.psc": "ScriptName Base extends Quest\nint Property Y auto\n"})
+		}, []string{"Base.psc", "Child.psc"}},
+		{"import edit", func() {
+			writeFiles(t, imports, map[string]string{"Actor.psc": "ScriptName Actor extends ObjectReference\nint x\n"})
+		}, []string{"Child.psc"}},
+		{"indirect import edit", func() {
+			writeFiles(t, imports, map[string]string{"Form.psc": "ScriptName Form\nint x\n"})
+		}, []string{"Base.psc", "Child.psc"}},
+		{"deleted compiled script", func() {
+			if err := os.Remove(filepath.Join(out, "Other.pex")); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"Other.psc"}},
+		{"flags change", func() { optimize = true }, all},
+		{"compiler change", func() {
+			writeFiles(t, dir, map[string]string{"PapyrusCompiler.exe": "v2"})
+		}, all},
+		{"unchanged after a full build", func() {}, nil},
+	}
+	for _, tt := range tests {
+		tt.change()
+		got := build()
+		if len(got) != len(tt.expected) {
+			t.Errorf("%s: compiled %v, expected %v", tt.name, got, tt.expected)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.expected[i] {
+				t.Errorf("%s: compiled %v, expected %v", tt.name, got, tt.expected)
+				break
+			}
+		}
+	}
+}
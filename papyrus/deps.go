@@ -0,0 +1,391 @@
+package papyrus
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// identifierRegex matches Papyrus identifiers, including namespaced ones (eg: MyMod:MyScript)
+var identifierRegex = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*(?::[A-Za-z_][A-Za-z0-9_]*)*`)
+
+// scriptNameRegex matches the ScriptName line of a Papyrus source
+var scriptNameRegex = regexp.MustCompile(`(?im)^\s*scriptname\s+([A-Za-z0-9_:]+)`)
+
+// scriptInfo contains the name of a script and the identifiers referenced in its source
+type scriptInfo struct {
+	// name is the lowercase script name
+	name string
+
+	// hash is the hash of the source
+	hash string
+
+	// references are the lowercase identifiers used in the script
+	references map[string]struct{}
+}
+
+// stripComments replaces comments and string literals in Papyrus source code with spaces,
+// so identifiers inside them are not considered. Newlines are kept.
+func stripComments(src []byte) []byte {
+	out := make([]byte, len(src))
+	blank := func(c byte) byte {
+		if c == '\n' {
+			return c
+		}
+		return ' '
+	}
+	for i := 0; i < len(src); i++ {
+		switch {
+		case src[i] == ';' && i+1 < len(src) && src[i+1] == '/':
+			// Block comment, ;/ ... /;
+			// The terminator is looked for after the opener, so ;/; does not end the comment.
+			out[i], out[i+1] = ' ', ' '
+			for i += 2; i < len(src) && !(src[i] == '/' && i+1 < len(src) && src[i+1] == ';'); i++ {
+				out[i] = blank(src[i])
+			}
+			if i < len(src) {
+				out[i], out[i+1] = ' ', ' '
+				i++
+			}
+		case src[i] == ';':
+			// Line comment
+			for ; i < len(src) && src[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+			if i < len(src) {
+				out[i] = '\n'
+			}
+		case src[i] == '{':
+			// Documentation comment
+			for ; i < len(src) && src[i] != '}'; i++ {
+				out[i] = blank(src[i])
+			}
+			if i < len(src) {
+				out[i] = ' '
+			}
+		case src[i] == '"':
+			// String literal, with backslash escapes
+			out[i] = ' '
+			for i++; i < len(src) && src[i] != '"' && src[i] != '\n'; i++ {
+				if src[i] == '\\' && i+1 < len(src) {
+					out[i] = ' '
+					i++
+				}
+				out[i] = blank(src[i])
+			}
+			if i < len(src) {
+				out[i] = blank(src[i])
+			}
+		default:
+			out[i] = src[i]
+		}
+	}
+	return out
+}
+
+// parseScript reads a Papyrus source and returns its name and the identifiers it references.
+// Every identifier is collected, so references in extends, Import, typed properties and
+// variables, casts and static function calls are all found. Identifiers that are not
+// script names are filtered out when building the dependency graph.
+func parseScript(path string) (*scriptInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read script %s: %v", path, err)
+	}
+	return parseSource(path, data, hashData(data)), nil
+}
+
+// parseSource parses the source data of the script at path, whose hash is hash
+func parseSource(path string, data []byte, hash string) *scriptInfo {
+	code := stripComments(data)
+	info := scriptInfo{
+		hash:       hash,
+		references: make(map[string]struct{}),
+	}
+	if m := scriptNameRegex.FindSubmatch(code); m != nil {
+		info.name = strings.ToLower(string(m[1]))
+	} else {
+		info.name = strings.ToLower(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	}
+	for _, identifier := range identifierRegex.FindAll(code, -1) {
+		info.references[strings.ToLower(string(identifier))] = struct{}{}
+	}
+	return &info
+}
+
+// hashData returns the sha256 of data
+func hashData(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// scriptGraph is the dependency graph of the scripts in a project
+type scriptGraph struct {
+	infos []*scriptInfo
+
+	// byName are the indexes of the scripts, by name
+	byName map[string]int
+
+	// dependents are the indexes of the scripts referencing each script, by name
+	dependents map[string][]int
+}
+
+// newScriptGraph parses all scripts and builds their dependency graph.
+// The scripts in the graph have the same indexes they have in scripts.
+func newScriptGraph(scripts []projectScript) (*scriptGraph, error) {
+	g := scriptGraph{
+		infos:      make([]*scriptInfo, len(scripts)),
+		byName:     make(map[string]int),
+		dependents: make(map[string][]int),
+	}
+	for i, s := range scripts {
+		info, err := parseScript(s.SourcePath)
+		if err != nil {
+			return nil, err
+		}
+		g.infos[i] = info
+		g.byName[info.name] = i
+	}
+	for i, info := range g.infos {
+		for ref := range info.references {
+			if _, ok := g.byName[ref]; ok && ref != info.name {
+				g.dependents[ref] = append(g.dependents[ref], i)
+			}
+		}
+	}
+	return &g, nil
+}
+
+// dependencies returns the hashes of the scripts the script i depends on, by name.
+// Project scripts are hashed by their source, scripts in the import folders by
+// their source and the ones of all the imported scripts they depend on.
+func (g *scriptGraph) dependencies(i int, imports *importIndex) (map[string]string, error) {
+	result := make(map[string]string)
+	for ref := range g.infos[i].references {
+		if j, ok := g.byName[ref]; ok {
+			if j != i {
+				result[ref] = g.infos[j].hash
+			}
+			continue
+		}
+		path, err := imports.path(ref)
+		if err != nil {
+			return nil, err
+		}
+		if path != "" {
+			hash, err := imports.closureHash(ref)
+			if err != nil {
+				return nil, err
+			}
+			result[ref] = hash
+		}
+	}
+	return result, nil
+}
+
+// addDependents marks as stale all the scripts that depend, directly or indirectly,
+// on a stale script, because the compiled scripts may be out of date even if their
+// sources did not change (eg: a parent script or the type of a property changed)
+func (g *scriptGraph) addDependents(scripts []projectScript) {
+	var queue []int
+	for i, s := range scripts {
+		if s.stale {
+			queue = append(queue, i)
+		}
+	}
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		for _, j := range g.dependents[g.infos[i].name] {
+			if !scripts[j].stale {
+				scripts[j].stale = true
+				queue = append(queue, j)
+			}
+		}
+	}
+}
+
+// importIndex resolves references to the scripts in the import folders
+// (eg: base game scripts, SKSE or other mods), that are not part of the project.
+// Import folders are not walked: a folder is listed only the first time a script
+// could be in it, and imported scripts are parsed only if their source changed
+// since the last build, so a build with nothing to compile stays cheap.
+type importIndex struct {
+	dirs  []string
+	graph *scriptGraph
+
+	// listings are the entries of the folders listed so far by lowercase name, by folder
+	listings map[string]map[string]os.FileInfo
+
+	// paths are the paths of the imported scripts, or "" if there is no such script, by name
+	paths map[string]string
+
+	// previous are the imported scripts parsed in the last build, by path
+	previous map[string]*importEntry
+
+	// entries are the imported scripts parsed in this build, by path
+	entries map[string]*importEntry
+
+	// infos are the parsed imported scripts, by name
+	infos map[string]*scriptInfo
+
+	// closureHashes are the hashes returned by closureHash, by name
+	closureHashes map[string]string
+}
+
+// newImportIndex returns an index of the scripts in the import folders dirs.
+// Project scripts in g are left out, they are tracked by the graph.
+// previous are the imported scripts parsed in the last build, by path.
+func newImportIndex(dirs []string, g *scriptGraph, previous map[string]*importEntry) *importIndex {
+	return &importIndex{
+		dirs:          dirs,
+		graph:         g,
+		listings:      make(map[string]map[string]os.FileInfo),
+		paths:         make(map[string]string),
+		previous:      previous,
+		entries:       make(map[string]*importEntry),
+		infos:         make(map[string]*scriptInfo),
+		closureHashes: make(map[string]string),
+	}
+}
+
+// path returns the path of the imported script name, or "" if it's not in the import folders.
+// Namespaces are subfolders (eg: MyMod:Quest is MyMod/Quest.psc) and names are case
+// insensitive. If a script is in multiple folders, the first one wins, like in the compiler.
+func (idx *importIndex) path(name string) (string, error) {
+	if p, ok := idx.paths[name]; ok {
+		return p, nil
+	}
+	var result string
+	if _, ok := idx.graph.byName[name]; !ok {
+		parts := strings.Split(name, ":")
+		for _, dir := range idx.dirs {
+			p, err := idx.find(dir, parts)
+			if err != nil {
+				return "", err
+			}
+			if p != "" {
+				result = p
+				break
+			}
+		}
+	}
+	idx.paths[name] = result
+	return result, nil
+}
+
+// find returns the path of the script whose namespaces and name are parts
+// in the import folder dir, or "" if it's not there
+func (idx *importIndex) find(dir string, parts []string) (string, error) {
+	for i, part := range parts {
+		entries, err := idx.list(dir)
+		if err != nil {
+			return "", err
+		}
+		isScript := i == len(parts)-1
+		if isScript {
+			part += ".psc"
+		}
+		entry, ok := entries[part]
+		if !ok || entry.IsDir() == isScript {
+			return "", nil
+		}
+		dir = filepath.Join(dir, entry.Name())
+	}
+	return dir, nil
+}
+
+// list returns the entries of the folder dir by lowercase name, listing it only the first time.
+// Folders that do not exist are empty.
+func (idx *importIndex) list(dir string) (map[string]os.FileInfo, error) {
+	if entries, ok := idx.listings[dir]; ok {
+		return entries, nil
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot list import folder %s: %v", dir, err)
+	}
+	entries := make(map[string]os.FileInfo, len(infos))
+	for _, info := range infos {
+		entries[strings.ToLower(info.Name())] = info
+	}
+	idx.listings[dir] = entries
+	return entries, nil
+}
+
+// info returns the parsed imported script name, parsing it only the first time.
+// The source is always read and hashed, but it's parsed again only if it
+// changed since the last build.
+func (idx *importIndex) info(name string) (*scriptInfo, error) {
+	if info, ok := idx.infos[name]; ok {
+		return info, nil
+	}
+	path, err := idx.path(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read script %s: %v", path, err)
+	}
+	hash := hashData(data)
+	entry, ok := idx.previous[path]
+	if !ok || entry.Hash != hash {
+		entry = newImportEntry(parseSource(path, data, hash))
+	}
+	idx.entries[path] = entry
+	info := entry.info()
+	idx.infos[name] = info
+	return info, nil
+}
+
+// closureHash returns a hash of the source of the imported script name and of
+// the sources of all the imported scripts it depends on, directly or indirectly,
+// so it changes if any of them changes (eg: a parent of a base game script).
+// The hash does not depend on the order the scripts are found in.
+func (idx *importIndex) closureHash(name string) (string, error) {
+	if hash, ok := idx.closureHashes[name]; ok {
+		return hash, nil
+	}
+	reachable := map[string]string{}
+	queue := []string{name}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if _, ok := reachable[current]; ok {
+			continue
+		}
+		info, err := idx.info(current)
+		if err != nil {
+			return "", err
+		}
+		reachable[current] = info.hash
+		for ref := range info.references {
+			path, err := idx.path(ref)
+			if err != nil {
+				return "", err
+			}
+			if path != "" {
+				queue = append(queue, ref)
+			}
+		}
+	}
+	names := make([]string, 0, len(reachable))
+	for n := range reachable {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, n := range names {
+		fmt.Fprintf(h, "%s=%s\n", n, reachable[n])
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	idx.closureHashes[name] = hash
+	return hash, nil
+}
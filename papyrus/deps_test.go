@@ -0,0 +1,206 @@
+package papyrus
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestStripComments(t *testing.T) {
+	tests := []struct {
+		src         string
+		identifiers []string
+	}{
+		{"int x ; Foo\nint y", []string{"int", "x", "int", "y"}},
+		{"a ;/ Foo\nBar /; b", []string{"a", "b"}},
+		{"a ;/;Foo/; b", []string{"a", "b"}},
+		{"a ;//; b", []string{"a", "b"}},
+		{"a ;/ Foo / ; Bar /; b", []string{"a", "b"}},
+		{"a ;/ Foo", []string{"a"}},
+		{"a { Foo\nBar } b", []string{"a", "b"}},
+		{`a = "Foo \" Bar" + b`, []string{"a", "b"}},
+		{`a = "Foo ; Bar" b ; c`, []string{"a", "b"}},
+		{"a \"Foo\nb", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		out := stripComments([]byte(tt.src))
+		if len(out) != len(tt.src) {
+			t.Errorf("stripComments(%q) = %q, changes the length", tt.src, out)
+			continue
+		}
+		for i := range out {
+			if (out[i] == '\n') != (tt.src[i] == '\n') {
+				t.Errorf("stripComments(%q) = %q, does not keep newlines", tt.src, out)
+				break
+			}
+		}
+		var identifiers []string
+		for _, identifier := range identifierRegex.FindAll(out, -1) {
+			identifiers = append(identifiers, string(identifier))
+		}
+		if !reflect.DeepEqual(identifiers, tt.identifiers) {
+			t.Errorf("stripComments(%q) = %q, identifiers are %q, expected %q", tt.src, out, identifiers, tt.identifiers)
+		}
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"MyMod/Quest.psc": "Scriptname MyMod:Quest extends Quest Hidden\n" +
+			"{ Documentation about ObjectReference }\n" +
+			"Import Utility\n" +
+			"Actor Property Target auto ; Game\n" +
+			";/ Weapon\n/;\n" +
+			"Function F()\n" +
+			"\tDebug.Trace(\"Armor\")\n" +
+			"\tMyMod:Other o = Target as MyMod:Other\n" +
+			"EndFunction\n",
+		"NoName.psc": "; No ScriptName line\n",
+	})
+	info, err := parseScript(filepath.Join(dir, "MyMod", "Quest.psc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.name != "mymod:quest" {
+		t.Errorf("name is %q, expected mymod:quest", info.name)
+	}
+	for _, ref := range []string{"quest", "utility", "actor", "target", "debug", "trace", "mymod:other"} {
+		if _, ok := info.references[ref]; !ok {
+			t.Errorf("reference %s not found", ref)
+		}
+	}
+	for _, ref := range []string{"objectreference", "game", "weapon", "armor", "Actor", "other"} {
+		if _, ok := info.references[ref]; ok {
+			t.Errorf("unexpected reference %s", ref)
+		}
+	}
+	info, err = parseScript(filepath.Join(dir, "NoName.psc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.name != "noname" {
+		t.Errorf("name is %q, expected the lowercase file name", info.name)
+	}
+	if info.hash != hashData([]byte("; No ScriptName line\n")) {
+		t.Errorf("hash is %s, expected the hash of the source", info.hash)
+	}
+}
+
+func TestClosureHash(t *testing.T) {
+	dir := t.TempDir()
+	imports, mods := filepath.Join(dir, "imports"), filepath.Join(dir, "mods")
+	writeFiles(t, imports, map[string]string{
+		"Actor.psc":           "ScriptName Actor extends ObjectReference\n",
+		"ObjectReference.psc": "ScriptName ObjectReference extends Form\n",
+		"Form.psc":            "ScriptName Form\n",
+		"Quest.psc":           "ScriptName Quest extends Form\n",
+		"Shadowed.psc":        "ScriptName Shadowed\n",
+		"Unused/Script.psc":   "ScriptName Unused:Script\n",
+	})
+	writeFiles(t, mods, map[string]string{
+		"MyLib/Util.psc": "ScriptName MyLib:Util extends Actor\nShadowed Property S auto\n",
+		"Actor.psc":      "ScriptName Actor\n",
+	})
+
+	// The project has a Shadowed script, changes to the imported one must be ignored
+	g := &scriptGraph{byName: map[string]int{"shadowed": 0}}
+	var previous map[string]*importEntry
+	closureHash := func(name string) string {
+		idx := newImportIndex([]string{imports, mods, filepath.Join(dir, "missing")}, g, previous)
+		hash, err := idx.closureHash(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := idx.listings[filepath.Join(imports, "Unused")]; ok {
+			t.Errorf("%s: folders of unused namespaces are listed", name)
+		}
+		previous = idx.entries
+		return hash
+	}
+
+	hash := closureHash("mylib:util")
+	if closureHash("mylib:util") != hash {
+		t.Fatal("hash changes without changes")
+	}
+	for _, tt := range []struct {
+		file    string
+		source  string
+		changes bool
+	}{
+		{"Quest.psc", "ScriptName Quest extends Form\nint x\n", false},
+		{"Shadowed.psc", "ScriptName Shadowed\nint x\n", false},
+		{"Unused/Script.psc", "ScriptName Unused:Script\nint x\n", false},
+		{"Form.psc", "ScriptName Form\nint x\n", true},
+		{"Actor.psc", "ScriptName Actor extends ObjectReference\nint x\n", true},
+	} {
+		writeFiles(t, imports, map[string]string{tt.file: tt.source})
+		newHash := closureHash("mylib:util")
+		if changes := newHash != hash; changes != tt.changes {
+			t.Errorf("%s changed: closure hash changed is %v, expected %v", tt.file, changes, tt.changes)
+		}
+		hash = newHash
+	}
+
+	// Imported scripts are parsed again only if they changed
+	before := previous[filepath.Join(imports, "Form.psc")]
+	closureHash("mylib:util")
+	if previous[filepath.Join(imports, "Form.psc")] != before {
+		t.Error("unchanged imported script parsed again")
+	}
+	writeFiles(t, imports, map[string]string{"Form.psc": "ScriptName Form\nint y\n"})
+	closureHash("mylib:util")
+	if entry := previous[filepath.Join(imports, "Form.psc")]; entry == before || !containsString(entry.References, "y") {
+		t.Error("changed imported script not parsed again")
+	}
+}
+
+// containsString returns true if the sorted slice s contains e
+func containsString(s []string, e string) bool {
+	i := sort.SearchStrings(s, e)
+	return i < len(s) && s[i] == e
+}
+
+func TestAddDependents(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"Base.psc":       "ScriptName Base extends Quest\n",
+		"Child.psc":      "ScriptName Child extends Base\n",
+		"GrandChild.psc": "ScriptName GrandChild extends Child\n",
+		"User.psc":       "ScriptName User\nGrandChild Property Target auto\n",
+		"Unrelated.psc":  "ScriptName Unrelated\n; Base is only mentioned in a comment\n",
+	}
+	writeFiles(t, dir, files)
+	names := []string{"Base.psc", "Child.psc", "GrandChild.psc", "User.psc", "Unrelated.psc"}
+	tests := []struct {
+		stale    string
+		expected []string
+	}{
+		{"Base.psc", []string{"Base.psc", "Child.psc", "GrandChild.psc", "User.psc"}},
+		{"Child.psc", []string{"Child.psc", "GrandChild.psc", "User.psc"}},
+		{"User.psc", []string{"User.psc"}},
+		{"Unrelated.psc", []string{"Unrelated.psc"}},
+	}
+	for _, tt := range tests {
+		scripts := make([]projectScript, len(names))
+		for i, name := range names {
+			scripts[i].SourcePath = filepath.Join(dir, name)
+			scripts[i].stale = name == tt.stale
+		}
+		g, err := newScriptGraph(scripts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.addDependents(scripts)
+		expected := make(map[string]bool)
+		for _, name := range tt.expected {
+			expected[name] = true
+		}
+		for i, name := range names {
+			if scripts[i].stale != expected[name] {
+				t.Errorf("%s changed: %s stale is %v, expected %v", tt.stale, name, scripts[i].stale, expected[name])
+			}
+		}
+	}
+}
@@ -19,6 +19,20 @@ type SourceScript struct {
 	DestinationFolder string
 }
 
+// projectScript represents a script found in the project source folders
+type projectScript struct {
+	SourceScript
+
+	// stale is true if the script has to be compiled
+	stale bool
+
+	// pexFileName is the path of the compiled script, relative to the output folders
+	pexFileName string
+
+	// outputFolder is the output folder containing the compiled script
+	outputFolder string
+}
+
 // CompilerResult represents the result of a papyrus script compilation
 type CompilerResult struct {
 	SourceScript *SourceScript
@@ -50,6 +64,30 @@ type Project struct {
 
 	// Folders is a slice of strings containing the paths of the folders we want to compile
 	Folders []string
+
+	// Recursive is true if the subfolders of Folders contain scripts too.
+	// Their relative path is mirrored in the output folders (eg: MyMod/Quest.psc -> MyMod/Quest.pex)
+	Recursive bool
+
+	// importRoots are the subfolders of Folders containing scripts without a namespace.
+	// They are imported too, so the compiler can find their scripts.
+	importRoots []string
+
+	// Archives is a slice of BSA archives we want to pack
+	Archives []Archive
+
+	// root is the folder containing the project file
+	root string
+
+	// cache is the build cache, loaded by GetScriptsToCompile
+	cache *buildCache
+
+	// pending are the cache entries of the scripts being compiled, by source path.
+	// They are added to the cache when the scripts are compiled successfully.
+	pending map[string]*cacheEntry
+
+	// cacheMutex protects cache and pending
+	cacheMutex sync.Mutex
 }
 
 // UnmarshalFile takes a path to a yaml file and tries
@@ -75,6 +113,11 @@ func UnmarshalFile(inputFileName string, config *config.Configuration) (*Project
 	if err != nil {
 		return nil, err
 	}
+	absInputFileName, err := filepath.Abs(inputFileName)
+	if err != nil {
+		return nil, err
+	}
+	newProject.root = filepath.Dir(absInputFileName)
 	return &newProject, nil
 }
 
@@ -111,6 +154,11 @@ func (p *Project) absPaths() error {
 		}
 		p.OutputFolders[i] = v
 	}
+	for i := 0; i < len(p.Archives); i++ {
+		if err := p.Archives[i].absPaths(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -140,72 +188,260 @@ func (p *Project) CheckFolders() error {
 	return nil
 }
 
-// GetScriptsToCompile returns all scripts that need to be compiled
-func (p *Project) GetScriptsToCompile() (*[]SourceScript, error) {
+// commonArgs returns the compiler arguments shared by all scripts
+func (p *Project) commonArgs() []string {
+	return p.argsWithImports(append(append([]string{}, p.Imports...), p.importRoots...))
+}
+
+// cacheFlags returns the compiler flags that invalidate the whole build cache when changed.
+// Import roots are left out: they are project folders, changes to their scripts
+// are tracked by the dependency graph, and new ones are added with new subfolders.
+func (p *Project) cacheFlags() string {
+	return strings.Join(p.argsWithImports(p.Imports), " ")
+}
+
+// argsWithImports returns the compiler arguments shared by all scripts, importing imports
+func (p *Project) argsWithImports(imports []string) []string {
+	args := []string{
+		arg{"i", strings.Join(imports, ";")}.String(),
+		arg{
+			"f",
+			"TESV_Papyrus_Flags.flg",
+		}.String(),
+	}
+	if p.Optimize {
+		args = append(args, "-o")
+	}
+	return args
+}
+
+// cachePath returns the path of the build cache of the project
+func (p *Project) cachePath() string {
+	return filepath.Join(p.root, cacheFile)
+}
+
+// GetScriptsToCompile returns all scripts that need to be compiled: scripts whose
+// compiled script is missing, whose source or dependencies changed since they were
+// last compiled, or that were compiled with a different compiler or flags, and all
+// the scripts that depend on them. Changes are detected by content, using the build cache.
+func (p *Project) GetScriptsToCompile(config config.Configuration) (*[]SourceScript, error) {
+	return p.getScripts(config, false)
+}
+
+// GetAllScripts returns all scripts in the project, regardless of the build cache.
+// The build cache is still updated with the scripts compiled successfully.
+func (p *Project) GetAllScripts(config config.Configuration) (*[]SourceScript, error) {
+	return p.getScripts(config, true)
+}
+
+// getScripts returns the scripts to compile, all of them if all is true
+func (p *Project) getScripts(config config.Configuration, all bool) (*[]SourceScript, error) {
+	scripts, err := p.sourceScripts()
+	if err != nil {
+		return nil, err
+	}
+	g, err := newScriptGraph(scripts)
+	if err != nil {
+		return nil, err
+	}
+	p.addImportRoots(scripts, g)
+
+	// The compiler writes namespaced scripts (eg: MyMod:Quest) to a subfolder of
+	// the output folder for each namespace (eg: MyMod/Quest.pex) on its own
+	for i := range scripts {
+		if strings.Contains(g.infos[i].name, ":") {
+			scripts[i].DestinationFolder = scripts[i].outputFolder
+		}
+	}
+
+	// Compare with the build cache
+	cache, err := loadBuildCache(p.cachePath())
+	if err != nil {
+		return nil, err
+	}
+	compilerHash, err := hashFile(config.CompilerPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot hash compiler: %v", err)
+	}
+	cache.reset(compilerHash, p.cacheFlags())
+	p.cache = cache
+	p.pending = make(map[string]*cacheEntry)
+	imports := newImportIndex(p.Imports, g, cache.Imports)
+	for i := range scripts {
+		dependencies, err := g.dependencies(i, imports)
+		if err != nil {
+			return nil, err
+		}
+		entry := &cacheEntry{
+			Hash:         g.infos[i].hash,
+			Output:       scripts[i].DestinationFolder,
+			Dependencies: dependencies,
+		}
+		p.pending[scripts[i].SourcePath] = entry
+		if all || !cache.upToDate(scripts[i].SourcePath, entry) {
+			scripts[i].stale = true
+		}
+	}
+	g.addDependents(scripts)
+
+	// Remember only the imported scripts used in this build
+	cache.Imports = imports.entries
+
+	// Forget the scripts that have been deleted
+	for sourcePath := range cache.Scripts {
+		if _, ok := p.pending[sourcePath]; !ok {
+			delete(cache.Scripts, sourcePath)
+		}
+	}
+
 	var sourceFiles []SourceScript
+	for _, s := range scripts {
+		if s.stale {
+			sourceFiles = append(sourceFiles, s.SourceScript)
+		}
+	}
+	return &sourceFiles, nil
+}
+
+// sourceScripts returns all scripts in the project source folders
+func (p *Project) sourceScripts() ([]projectScript, error) {
+	var scripts []projectScript
 	for _, inputFolder := range p.Folders {
-		r, err := p.walkSourceDir(inputFolder)
+		r, err := p.walkSourceDir(inputFolder, "")
 		if err != nil {
 			return nil, err
 		}
-		sourceFiles = append(sourceFiles, *r...)
+		scripts = append(scripts, *r...)
 	}
-	return &sourceFiles, nil
+	return scripts, nil
+}
+
+// Clean deletes the compiled scripts of all scripts in the project source folders
+// from all output folders, and the build cache. Other compiled scripts in the
+// output folders (eg: from other mods) are left untouched.
+// It returns the paths of the deleted files.
+func (p *Project) Clean() ([]string, error) {
+	scripts, err := p.sourceScripts()
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+	for _, s := range scripts {
+		for _, of := range p.OutputFolders {
+			pexPath := filepath.Join(of, s.pexFileName)
+			if err := os.Remove(pexPath); err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return deleted, fmt.Errorf("cannot delete %s: %v", pexPath, err)
+			}
+			deleted = append(deleted, pexPath)
+		}
+	}
+	if err := os.Remove(p.cachePath()); err != nil && !os.IsNotExist(err) {
+		return deleted, fmt.Errorf("cannot delete build cache: %v", err)
+	}
+	return deleted, nil
 }
 
 // CompileWorker starts a papyrus compiler to compile
-// scripts received from the "c" channel.
-// It reports results in the "results" channel.
-func (p *Project) CompileWorker(config config.Configuration, wg *sync.WaitGroup, c <-chan *SourceScript, results chan<- *CompilerResult) {
+// batches of scripts received from the "c" channel.
+// It reports the result of each script in the "results" channel.
+func (p *Project) CompileWorker(config config.Configuration, wg *sync.WaitGroup, c <-chan []*SourceScript, results chan<- *CompilerResult) {
 	defer wg.Done()
-	for sourceFile := range c {
-		fmt.Printf("Compiling %s -> %s\n", filepath.Base(sourceFile.SourcePath), sourceFile.DestinationFolder)
-		args := []string{
-			sourceFile.SourcePath,
-			arg{"o", sourceFile.DestinationFolder}.String(),
-			arg{"i", strings.Join(p.Imports, ";")}.String(),
-			arg{
-				"f",
-				"TESV_Papyrus_Flags.flg",
-			}.String(),
+	for batch := range c {
+		for _, sourceFile := range batch {
+			fmt.Printf("Compiling %s -> %s\n", filepath.Base(sourceFile.SourcePath), sourceFile.DestinationFolder)
 		}
-		if p.Optimize {
-			args = append(args, "-o")
+		if err := os.MkdirAll(batch[0].DestinationFolder, 0755); err != nil {
+			for _, sourceFile := range batch {
+				results <- &CompilerResult{
+					SourceScript: sourceFile,
+					Err:          fmt.Errorf("cannot create output folder: %v", err),
+				}
+			}
+			continue
 		}
-		compilerCmd := exec.Command(config.CompilerPath, args...)
-		compilerOut, err := compilerCmd.CombinedOutput()
-		results <- &CompilerResult{
-			SourceScript: sourceFile,
-			Command:      strings.Join(args, " "),
-			Err:          err,
-			Output:       string(compilerOut),
+
+		// Namespaced scripts are found from the source folder root, so
+		// they can be compiled only one at a time, from their own path
+		if dir := filepath.Dir(batch[0].SourcePath); len(batch) > 1 && (contains(p.Imports, dir) || contains(p.importRoots, dir)) {
+			for _, result := range p.compileBatch(config, batch) {
+				results <- result
+			}
+			continue
 		}
+		for _, sourceFile := range batch {
+			results <- p.compile(config, sourceFile)
+		}
+	}
+}
+
+// compile compiles a single script
+func (p *Project) compile(config config.Configuration, sourceFile *SourceScript) *CompilerResult {
+	args := []string{
+		sourceFile.SourcePath,
+		arg{"o", sourceFile.DestinationFolder}.String(),
+	}
+	args = append(args, p.commonArgs()...)
+	compilerCmd := exec.Command(config.CompilerPath, args...)
+	compilerOut, err := compilerCmd.CombinedOutput()
+	return &CompilerResult{
+		SourceScript: sourceFile,
+		Command:      strings.Join(args, " "),
+		Err:          err,
+		Output:       string(compilerOut),
+	}
+}
+
+// MarkCompiled adds a script compiled successfully to the build cache.
+// It's safe to call it from multiple goroutines.
+func (p *Project) MarkCompiled(s *SourceScript) {
+	p.cacheMutex.Lock()
+	defer p.cacheMutex.Unlock()
+	if entry, ok := p.pending[s.SourcePath]; ok {
+		p.cache.Scripts[s.SourcePath] = entry
+	}
+}
+
+// SaveBuildCache writes the build cache to the .papy folder in the project root
+func (p *Project) SaveBuildCache() error {
+	p.cacheMutex.Lock()
+	defer p.cacheMutex.Unlock()
+	if p.cache == nil {
+		return nil
 	}
+	return p.cache.save(p.cachePath())
 }
 
-func (p *Project) walkSourceDir(dir string) (*[]SourceScript, error) {
-	var result []SourceScript
+// walkSourceDir returns all scripts in the folder rel, relative to the source folder root,
+// and whether their compiled script is missing. Subfolders are walked only if the project
+// is recursive, and their relative path is mirrored in the output folders.
+func (p *Project) walkSourceDir(root string, rel string) (*[]projectScript, error) {
+	var result []projectScript
+	dir := filepath.Join(root, rel)
 	entries, err := dirents(dir)
 	if err != nil {
 		return nil, err
 	}
 	for _, pscInfo := range entries {
 		pscFileName := pscInfo.Name()
-		var foundPexDir string
+		var foundPexDir, foundOutputFolder string
 		var foundPexInfo os.FileInfo
 		if pscInfo.IsDir() {
-			// Folder, walk recursively
-			// Skyrim has all scripts in one folder, so no.
-			/*subdir := filepath.Join(dir, pscInfo.Name())
-			subEntries, err := p.walkSourceDir(subdir)
+			// Folder, walk recursively.
+			// Skyrim has all scripts in one folder, so only if the project is recursive.
+			if !p.Recursive {
+				continue
+			}
+			subEntries, err := p.walkSourceDir(root, filepath.Join(rel, pscFileName))
 			if err != nil {
 				return nil, err
 			}
-			result = append(result, *subEntries...)*/
-			continue
+			result = append(result, *subEntries...)
 		} else if filepath.Ext(pscFileName) == ".psc" {
 			// .psc file, check if we should rebuild this
-			pexFileName := pscFileName[:len(pscFileName)-4] + ".pex"
+			pexFileName := filepath.Join(rel, pscFileName[:len(pscFileName)-4]+".pex")
 			for _, of := range p.OutputFolders {
 				pexPath := filepath.Join(of, pexFileName)
 				pexInfo, err := os.Stat(pexPath)
@@ -216,6 +452,7 @@ func (p *Project) walkSourceDir(dir string) (*[]SourceScript, error) {
 						return nil, fmt.Errorf("%s is dir, expected filr", pexPath)
 					} else {
 						foundPexDir = pexPath
+						foundOutputFolder = of
 						foundPexInfo = pexInfo
 						break
 					}
@@ -225,24 +462,46 @@ func (p *Project) walkSourceDir(dir string) (*[]SourceScript, error) {
 			if foundPexInfo == nil {
 				// .pex does not exist in any folders, it needs to be built!
 				// send it to the primary folder
-				result = append(result, SourceScript{
-					filepath.Join(dir, pscFileName),
+				result = append(result, projectScript{
+					SourceScript{
+						filepath.Join(dir, pscFileName),
+						filepath.Join(p.OutputFolders[0], rel),
+					},
+					true,
+					pexFileName,
 					p.OutputFolders[0],
 				})
 				continue
 			}
-			if pscInfo.ModTime().After(foundPexInfo.ModTime()) {
-				// File modified, it needs to be rebuilt!
-				result = append(result, SourceScript{
+
+			// Whether it has been modified is decided by the build cache
+			result = append(result, projectScript{
+				SourceScript{
 					filepath.Join(dir, pscFileName),
 					filepath.Dir(foundPexDir),
-				})
-			}
+				},
+				false,
+				pexFileName,
+				foundOutputFolder,
+			})
 		}
 	}
 	return &result, nil
 }
 
+// addImportRoots adds the subfolders containing scripts without a namespace to the
+// import roots, so the compiler can find them. Namespaced scripts (eg: MyMod:Quest in
+// MyMod/Quest.psc) are found from the source folder, that is already imported.
+func (p *Project) addImportRoots(scripts []projectScript, g *scriptGraph) {
+	for i, s := range scripts {
+		dir := filepath.Dir(s.SourcePath)
+		if strings.Contains(g.infos[i].name, ":") || contains(p.Folders, dir) || contains(p.Imports, dir) || contains(p.importRoots, dir) {
+			continue
+		}
+		p.importRoots = append(p.importRoots, dir)
+	}
+}
+
 // dirents returns all entries (files and folders) in the current folder
 func dirents(dir string) ([]os.FileInfo, error) {
 	entries, err := ioutil.ReadDir(dir)
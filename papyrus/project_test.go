@@ -0,0 +1,166 @@
+package papyrus
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/xnyo/papy/config"
+)
+
+func TestRecursiveScripts(t *testing.T) {
+	dir := t.TempDir()
+	src, imports := filepath.Join(dir, "src"), filepath.Join(dir, "imports")
+	out, otherOut := filepath.Join(dir, "out"), filepath.Join(dir, "other out")
+	writeFiles(t, src, map[string]string{
+		"Top.psc":                 "ScriptName Top\n",
+		"MyMod/Quest.psc":         "ScriptName MyMod:Quest\n",
+		"MyMod/Compiled.psc":      "ScriptName MyMod:Compiled\n",
+		"MyMod/Sub/Alias.psc":     "ScriptName MyMod:Sub:Alias\n",
+		"MyMod/Sub/Namespace.psc": "ScriptName MyMod:Sub:Namespace\n",
+		"Plain/Helper.psc":        "ScriptName Helper\n",
+		"Plain/Compiled.psc":      "ScriptName Compiled\n",
+		"Plain/NotAScript.txt":    "ScriptName NotAScript\n",
+		"Plain/Deep/Deeper.psc":   "ScriptName Deeper\n",
+		"Plain/Deep/Another.psc":  "ScriptName Another\n",
+		"Imported/Imported.psc":   "ScriptName Imported\n",
+	})
+	writeFiles(t, imports, map[string]string{"Form.psc": "ScriptName Form\n"})
+	// Scripts already compiled to the second output folder stay there
+	writeFiles(t, otherOut, map[string]string{
+		"MyMod/Compiled.pex": "",
+		"Plain/Compiled.pex": "",
+	})
+	writeFiles(t, dir, map[string]string{"PapyrusCompiler.exe": ""})
+	cfg := config.Configuration{CompilerPath: filepath.Join(dir, "PapyrusCompiler.exe")}
+
+	tests := []struct {
+		recursive    bool
+		destinations map[string]string
+		importRoots  []string
+	}{
+		{
+			false,
+			map[string]string{
+				"Top.psc": out,
+			},
+			nil,
+		},
+		{
+			true,
+			map[string]string{
+				"Top.psc":                 out,
+				"MyMod/Quest.psc":         out,
+				"MyMod/Sub/Alias.psc":     out,
+				"MyMod/Sub/Namespace.psc": out,
+				"MyMod/Compiled.psc":      otherOut,
+				"Plain/Helper.psc":        filepath.Join(out, "Plain"),
+				"Plain/Compiled.psc":      filepath.Join(otherOut, "Plain"),
+				"Plain/Deep/Deeper.psc":   filepath.Join(out, "Plain", "Deep"),
+				"Plain/Deep/Another.psc":  filepath.Join(out, "Plain", "Deep"),
+				"Imported/Imported.psc":   filepath.Join(out, "Imported"),
+			},
+			[]string{filepath.Join(src, "Plain"), filepath.Join(src, "Plain", "Deep")},
+		},
+	}
+	for _, tt := range tests {
+		p := &Project{
+			Folders:       []string{src},
+			Imports:       []string{imports, src, filepath.Join(src, "Imported")},
+			OutputFolders: []string{out, otherOut},
+			Recursive:     tt.recursive,
+			root:          dir,
+		}
+		scripts, err := p.GetAllScripts(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		destinations := make(map[string]string)
+		for _, s := range *scripts {
+			rel, err := filepath.Rel(src, s.SourcePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			destinations[filepath.ToSlash(rel)] = s.DestinationFolder
+		}
+		if !reflect.DeepEqual(destinations, tt.destinations) {
+			t.Errorf("recursive %v: destinations are %v, expected %v", tt.recursive, destinations, tt.destinations)
+		}
+
+		// Subfolders with scripts without a namespace are imported after the import folders,
+		// the ones with namespaced scripts and the ones already imported are not
+		if !reflect.DeepEqual(p.importRoots, tt.importRoots) {
+			t.Errorf("recursive %v: import roots are %v, expected %v", tt.recursive, p.importRoots, tt.importRoots)
+		}
+		expected := arg{"i", strings.Join(append(append([]string{}, p.Imports...), tt.importRoots...), ";")}.String()
+		if args := p.commonArgs(); args[0] != expected {
+			t.Errorf("recursive %v: compiler arguments are %v, expected %s", tt.recursive, args, expected)
+		}
+	}
+}
+
+func TestClean(t *testing.T) {
+	dir := t.TempDir()
+	src, out, otherOut := filepath.Join(dir, "src"), filepath.Join(dir, "out"), filepath.Join(dir, "other out")
+	writeFiles(t, src, map[string]string{
+		"Quest.psc":       "ScriptName Quest\n",
+		"Sub/Helper.psc":  "ScriptName Helper\n",
+		"MyMod/Alias.psc": "ScriptName MyMod:Alias\n",
+	})
+	compiled := []string{
+		filepath.Join(out, "Quest.pex"),
+		filepath.Join(out, "Sub", "Helper.pex"),
+		filepath.Join(otherOut, "Quest.pex"),
+		filepath.Join(otherOut, "MyMod", "Alias.pex"),
+	}
+	unrelated := []string{
+		filepath.Join(out, "Unrelated.pex"),
+		filepath.Join(out, "Sub", "Quest.pex"),
+		filepath.Join(out, "Helper.pex"),
+		filepath.Join(out, "Quest.psc"),
+		filepath.Join(otherOut, "MyMod", "Quest.pex"),
+		filepath.Join(src, "Quest.pex"),
+	}
+	for _, path := range append(append([]string{}, compiled...), unrelated...) {
+		writeFiles(t, filepath.Dir(path), map[string]string{filepath.Base(path): ""})
+	}
+	writeFiles(t, dir, map[string]string{cacheFile: "{}"})
+
+	p := &Project{
+		Folders:       []string{src},
+		Imports:       []string{src},
+		OutputFolders: []string{out, otherOut},
+		Recursive:     true,
+		root:          dir,
+	}
+	deleted, err := p.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(deleted)
+	sort.Strings(compiled)
+	if !reflect.DeepEqual(deleted, compiled) {
+		t.Errorf("deleted %v, expected %v", deleted, compiled)
+	}
+	for _, path := range compiled {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s not deleted", path)
+		}
+	}
+	for _, path := range unrelated {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("unrelated file %s deleted: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(p.cachePath()); !os.IsNotExist(err) {
+		t.Error("build cache not deleted")
+	}
+
+	// Nothing left to delete
+	if deleted, err := p.Clean(); err != nil || len(deleted) > 0 {
+		t.Errorf("second clean deleted %v, error %v", deleted, err)
+	}
+}